@@ -2,12 +2,18 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
+	"os"
+	"strings"
 
 	"github.com/mjneil/go-chunked-streaming-server/server"
 )
 
 var (
+	configFilePath               = flag.String("config", "", "JSON config file path (flags and env vars override its values)")
+	printConfig                  = flag.Bool("print-config", false, "Prints the resulting config and exits")
+	validateConfig               = flag.Bool("validate", false, "Validates the resulting config and exits")
 	certFilePath                 = flag.String("c", "", "Certificate file path (only for https)")
 	keyFilePath                  = flag.String("k", "", "Key file path (only for https)")
 	baseOutPath                  = flag.String("p", "./content", "Path used to store")
@@ -24,8 +30,66 @@ func checkError(err error) {
 	}
 }
 
+// loadConfig Builds the config applying (in order) defaults, config file, env vars and explicitly set flags
+func loadConfig() (*server.Config, error) {
+	config := server.NewConfig()
+
+	if *configFilePath != "" {
+		err := config.LoadFromDisc(*configFilePath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := config.LoadFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the flags present in the command line override the config
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "c":
+			config.TLS.CertFile = *certFilePath
+		case "k":
+			config.TLS.KeyFile = *keyFilePath
+		case "p":
+			config.Storage.BasePath = *baseOutPath
+		case "i":
+			config.Listen.Port = *port
+		case "o":
+			config.Cors.FilePath = *corsConfigFilePath
+		case "r":
+			config.Storage.OnlyRAM = *onlyRAM
+		case "w":
+			config.WaitingRequests.Enabled = *waitForDataToArrive
+		case "d":
+			config.Cleanup.Enabled = *doCleanupBasedOnCacheHeaders
+		}
+	})
+
+	return config, nil
+}
+
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintf(flag.CommandLine.Output(), "Env vars that override the config file:\n  %s\n", strings.Join(server.NewConfig().EnvNames(), "\n  "))
+	}
 	flag.Parse()
 
-	checkError(server.StartHTTPServer(*baseOutPath, *port, *certFilePath, *keyFilePath, *corsConfigFilePath, *onlyRAM, *doCleanupBasedOnCacheHeaders, *waitForDataToArrive))
+	config, err := loadConfig()
+	checkError(err)
+
+	if *printConfig {
+		fmt.Println(config.String())
+	}
+	if *printConfig || *validateConfig {
+		checkError(config.Validate())
+		fmt.Println("Config OK")
+		return
+	}
+
+	checkError(server.StartHTTPServer(config))
 }
@@ -0,0 +1,310 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Admin API to inspect and manage the stored objects
+type Admin struct {
+	config          *Config
+	waitingRequests *WaitingRequests
+	replicator      *Replicator
+	webhooks        *Webhooks
+	hls             *HLS
+	dash            *DASH
+}
+
+// NewAdmin Creates a new Admin object
+func NewAdmin(config *Config, waitingRequests *WaitingRequests, replicator *Replicator, webhooks *Webhooks, hls *HLS, dash *DASH) *Admin {
+	return &Admin{
+		config:          config,
+		waitingRequests: waitingRequests,
+		replicator:      replicator,
+		webhooks:        webhooks,
+		hls:             hls,
+		dash:            dash,
+	}
+}
+
+// AddRoutes Adds the admin endpoints under the configured path prefix
+//
+//	GET  <prefix>/objects[?prefix=/live/]  List objects
+//	GET  <prefix>/objects/info?key=/a.ts    Object info
+//	POST <prefix>/objects/expire?key=/a.ts  Removes the object now
+//	POST <prefix>/objects/evict?key=/a.ts   Moves a complete object from RAM to disk
+//	POST <prefix>/objects/pin?key=/a.ts     Object will not be removed by the clean up
+//	POST <prefix>/objects/unpin?key=/a.ts   Undo pin
+//	GET  <prefix>/objects/index?key=/a.m4s  Media index (Ex: fMP4 fragments)
+//	GET  <prefix>/waiting                   Waiting requests per key
+//	GET  <prefix>/replication               Replication stats per peer
+//	GET  <prefix>/readers                   Lag of the live readers and slow reader counters
+//	GET  <prefix>/webhooks                  Delivery stats per webhook
+//	GET  <prefix>/hls                       Generated HLS playlists
+//	POST <prefix>/hls/end?key=/a.m3u8      Ends the stream of a generated playlist
+//	GET  <prefix>/dash                      Generated DASH MPDs
+//	POST <prefix>/dash/end?key=/a.mpd       Ends the presentation of a generated MPD
+func (a *Admin) AddRoutes(r *mux.Router) {
+	s := r.PathPrefix(a.config.Admin.PathPrefix).Subrouter()
+	s.Use(a.authMiddleware)
+
+	s.HandleFunc("/objects", a.listHandler).Methods(http.MethodGet)
+	s.HandleFunc("/objects/info", a.infoHandler).Methods(http.MethodGet)
+	s.HandleFunc("/objects/expire", a.expireHandler).Methods(http.MethodPost)
+	s.HandleFunc("/objects/evict", a.evictHandler).Methods(http.MethodPost)
+	s.HandleFunc("/objects/pin", a.pinHandler(true)).Methods(http.MethodPost)
+	s.HandleFunc("/objects/unpin", a.pinHandler(false)).Methods(http.MethodPost)
+	s.HandleFunc("/objects/index", a.indexHandler).Methods(http.MethodGet)
+	s.HandleFunc("/waiting", a.waitingHandler).Methods(http.MethodGet)
+	s.HandleFunc("/replication", a.replicationHandler).Methods(http.MethodGet)
+	s.HandleFunc("/readers", a.readersHandler).Methods(http.MethodGet)
+	s.HandleFunc("/webhooks", a.webhooksHandler).Methods(http.MethodGet)
+	s.HandleFunc("/hls", a.hlsHandler).Methods(http.MethodGet)
+	s.HandleFunc("/hls/end", a.hlsEndHandler).Methods(http.MethodPost)
+	s.HandleFunc("/dash", a.dashHandler).Methods(http.MethodGet)
+	s.HandleFunc("/dash/end", a.dashEndHandler).Methods(http.MethodPost)
+}
+
+func (a *Admin) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !hasValidToken(a.config.Admin.Tokens, r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *Admin) listHandler(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+
+	FilesLock.RLock()
+	files := make([]*File, 0, len(Files))
+	for key, f := range Files {
+		if strings.HasPrefix(key, prefix) {
+			files = append(files, f)
+		}
+	}
+	FilesLock.RUnlock()
+
+	waiting := a.getWaitingCounts()
+	infos := make([]FileInfo, 0, len(files))
+	for _, f := range files {
+		info := f.GetInfo()
+		info.Waiting = waiting[info.Key]
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+
+	writeJSON(w, http.StatusOK, infos)
+}
+
+func (a *Admin) infoHandler(w http.ResponseWriter, r *http.Request) {
+	f, ok := a.getFile(w, r)
+	if !ok {
+		return
+	}
+
+	info := f.GetInfo()
+	info.Waiting = a.getWaitingCounts()[info.Key]
+
+	writeJSON(w, http.StatusOK, info)
+}
+
+func (a *Admin) expireHandler(w http.ResponseWriter, r *http.Request) {
+	f, ok := a.getFile(w, r)
+	if !ok {
+		return
+	}
+
+	if _, complete := f.getSize(); !complete {
+		// Live readers get ErrUploadFailed, and the upload is aborted
+		f.Fail()
+	}
+	FilesLock.Lock()
+	if Files[f.Name] == f {
+		delete(Files, f.Name)
+	}
+	FilesLock.Unlock()
+	unscheduleExpiry(f)
+
+	if !a.config.Storage.OnlyRAM {
+		f.RemoveFromDisk(a.config.Storage.BasePath)
+	}
+	logDebugf("ADMIN expired, deleted: %s", f.Name)
+	publishEvent(EventExpired, f)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Admin) evictHandler(w http.ResponseWriter, r *http.Request) {
+	f, ok := a.getFile(w, r)
+	if !ok {
+		return
+	}
+
+	if a.config.Storage.OnlyRAM {
+		writeJSONError(w, http.StatusConflict, "server is configured as only RAM")
+		return
+	}
+	info := f.GetInfo()
+	if !info.Complete {
+		writeJSONError(w, http.StatusConflict, "object is still being ingested")
+		return
+	}
+	if info.Storage != "ram" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	err := f.WriteToDisk(a.config.Storage.BasePath)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Admin) pinHandler(pinned bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f, ok := a.getFile(w, r)
+		if !ok {
+			return
+		}
+
+		f.SetPinned(pinned)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (a *Admin) indexHandler(w http.ResponseWriter, r *http.Request) {
+	f, ok := a.getFile(w, r)
+	if !ok {
+		return
+	}
+
+	info, ok := f.GetIndexInfo()
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "object is not indexed")
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+func (a *Admin) waitingHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.getWaitingCounts())
+}
+
+func (a *Admin) replicationHandler(w http.ResponseWriter, r *http.Request) {
+	stats := []ReplicationStats{}
+	if a.replicator != nil {
+		stats = a.replicator.GetStats()
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+func (a *Admin) readersHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, GetEgressStats())
+}
+
+func (a *Admin) webhooksHandler(w http.ResponseWriter, r *http.Request) {
+	stats := []WebhookStats{}
+	if a.webhooks != nil {
+		stats = a.webhooks.GetStats()
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+func (a *Admin) hlsHandler(w http.ResponseWriter, r *http.Request) {
+	playlists := []HLSPlaylistInfo{}
+	if a.hls != nil {
+		playlists = a.hls.GetPlaylists()
+	}
+	writeJSON(w, http.StatusOK, playlists)
+}
+
+func (a *Admin) hlsEndHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		writeJSONError(w, http.StatusBadRequest, "key query param is required")
+		return
+	}
+	if a.hls == nil || !a.hls.End(key) {
+		writeJSONError(w, http.StatusNotFound, "playlist not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Admin) dashHandler(w http.ResponseWriter, r *http.Request) {
+	manifests := []DASHManifestInfo{}
+	if a.dash != nil {
+		manifests = a.dash.GetManifests()
+	}
+	writeJSON(w, http.StatusOK, manifests)
+}
+
+func (a *Admin) dashEndHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		writeJSONError(w, http.StatusBadRequest, "key query param is required")
+		return
+	}
+	if a.dash == nil || !a.dash.End(key) {
+		writeJSONError(w, http.StatusNotFound, "manifest not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getFile Returns the file indicated by the key query param, or writes the error response
+func (a *Admin) getFile(w http.ResponseWriter, r *http.Request) (*File, bool) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		writeJSONError(w, http.StatusBadRequest, "key query param is required")
+		return nil, false
+	}
+
+	FilesLock.RLock()
+	f, ok := Files[key]
+	FilesLock.RUnlock()
+
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "object not found")
+		return nil, false
+	}
+
+	return f, true
+}
+
+func (a *Admin) getWaitingCounts() map[string]int {
+	if a.waitingRequests == nil {
+		return map[string]int{}
+	}
+	return a.waitingRequests.GetWaitingCounts()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
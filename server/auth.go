@@ -0,0 +1,77 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// accessTokenParam Query param with the bearer token of the WebSocket ingest and egress
+const accessTokenParam = "access_token"
+
+// isAuthorized Checks the bearer token of the request against the tokens configured for its direction
+func isAuthorized(auth AuthConfig, r *http.Request) bool {
+	tokens := auth.EgressTokens
+	switch r.Method {
+	case http.MethodPost, http.MethodPut, http.MethodDelete:
+		tokens = auth.IngestTokens
+	case http.MethodOptions:
+		// CORS preflight never carries credentials
+		return true
+	}
+
+	return hasValidToken(tokens, r)
+}
+
+// isWebSocketIngestAuthorized Browsers can not set headers on WebSockets, so the ingest token can also be in the access_token query param
+func isWebSocketIngestAuthorized(auth AuthConfig, r *http.Request) bool {
+	return hasValidToken(auth.IngestTokens, r) || hasValidQueryToken(auth.IngestTokens, r)
+}
+
+// isWebSocketEgressAuthorized Same as the ingest, the egress token can also be in the access_token query param
+func isWebSocketEgressAuthorized(auth AuthConfig, r *http.Request) bool {
+	return hasValidToken(auth.EgressTokens, r) || hasValidQueryToken(auth.EgressTokens, r)
+}
+
+// hasValidQueryToken Checks the access_token query param is one of tokens
+func hasValidQueryToken(tokens []string, r *http.Request) bool {
+	token := r.URL.Query().Get(accessTokenParam)
+	if token == "" {
+		return false
+	}
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasValidToken Checks the bearer token of the request is one of tokens (always true if there are no tokens)
+func hasValidToken(tokens []string, r *http.Request) bool {
+	if len(tokens) <= 0 {
+		return true
+	}
+
+	token := getBearerToken(r.Header.Get("Authorization"))
+	if token == "" {
+		return false
+	}
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func getBearerToken(s string) string {
+	const prefix = "Bearer "
+	if len(s) < len(prefix) || !strings.EqualFold(s[:len(prefix)], prefix) {
+		return ""
+	}
+
+	return strings.TrimSpace(s[len(prefix):])
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// defaultContentTypes Types of the usual streaming extensions
+var defaultContentTypes = map[string]string{
+	".m3u8": "application/vnd.apple.mpegurl",
+	".mpd":  "application/dash+xml",
+	".ts":   "video/mp2t",
+	".m4s":  "video/iso.segment",
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".m4a":  "audio/mp4",
+	".cmfv": "video/mp4",
+	".cmfa": "audio/mp4",
+	".cmft": "application/mp4",
+	".vtt":  "text/vtt",
+	".aac":  "audio/aac",
+	".mp3":  "audio/mpeg",
+	".webm": "video/webm",
+}
+
+// contentTypes Inference used by the ingest paths, replaced by StartHTTPServer with the configured one
+var contentTypes = NewContentTypes(NewConfig().ContentTypes)
+
+// ContentTypes Decides the Content-Type of the objects: forced per prefix, the uploaded one, by extension,
+// or sniffed from the first chunk (in this order)
+type ContentTypes struct {
+	extensions map[string]string
+	sniff      bool
+	rules      []ContentTypeRule
+}
+
+// NewContentTypes Creates a new ContentTypes object, the configured extensions are added to (or replace) the defaults
+func NewContentTypes(config ContentTypesConfig) *ContentTypes {
+	ct := ContentTypes{
+		extensions: map[string]string{},
+		sniff:      config.Sniff,
+		rules:      config.Rules,
+	}
+	for ext, contentType := range defaultContentTypes {
+		ct.extensions[ext] = contentType
+	}
+	for ext, contentType := range config.Extensions {
+		ct.extensions[strings.ToLower(ext)] = contentType
+	}
+
+	return &ct
+}
+
+// apply Sets the Content-Type in the headers of a new object, if it is forced or missing
+func (ct *ContentTypes) apply(key string, headers http.Header) {
+	if forced := ct.getForced(key); forced != "" {
+		headers.Set("Content-Type", forced)
+		return
+	}
+	if headers.Get("Content-Type") != "" {
+		return
+	}
+
+	if contentType, ok := ct.extensions[getKeyExtension(key)]; ok {
+		headers.Set("Content-Type", contentType)
+	}
+}
+
+// getKeyExtension Returns the extension (lower case) of the path of a key, without the query
+func getKeyExtension(key string) string {
+	if idx := strings.Index(key, "?"); idx >= 0 {
+		key = key[:idx]
+	}
+	return strings.ToLower(path.Ext(key))
+}
+
+// getForced Returns the type of the last rule that matches key, empty if none
+func (ct *ContentTypes) getForced(key string) string {
+	ret := ""
+	for _, rule := range ct.rules {
+		if matchesKey(rule.Match, key) {
+			ret = rule.Type
+		}
+	}
+	return ret
+}
+
+// detect Returns the type of the first chunk of an object, empty if sniffing is disabled or it is unknown
+func (ct *ContentTypes) detect(p []byte) string {
+	if !ct.sniff || len(p) <= 0 {
+		return ""
+	}
+
+	switch {
+	case len(p) > tsPacketSize && p[0] == tsSyncByte && p[tsPacketSize] == tsSyncByte:
+		// Two packets, a single 0x47 ('G') could be anything
+		return "video/mp2t"
+	case len(p) >= 8 && isISOBMFFBox(p[4:8]):
+		return "video/mp4"
+	case bytes.HasPrefix(p, []byte("#EXTM3U")):
+		return "application/vnd.apple.mpegurl"
+	case bytes.HasPrefix(p, []byte("WEBVTT")):
+		return "text/vtt"
+	case len(p) >= 2 && p[0] == 0xFF && (p[1]&0xF6) == 0xF0:
+		// ADTS sync word, layer 0
+		return "audio/aac"
+	case bytes.Contains(p[:min(len(p), 512)], []byte("<MPD")):
+		return "application/dash+xml"
+	}
+
+	contentType := http.DetectContentType(p)
+	if contentType == "application/octet-stream" {
+		return ""
+	}
+	return contentType
+}
+
+func isISOBMFFBox(boxType []byte) bool {
+	switch string(boxType) {
+	case "ftyp", "styp", "moof", "moov", "sidx", "emsg", "prft":
+		return true
+	}
+	return false
+}
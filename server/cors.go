@@ -45,6 +45,26 @@ func (c *Cors) LoadFromDisc(configFilePath string) error {
 	return nil
 }
 
+// LoadFromData Initializes CORS from config data, returns false if there is nothing to apply
+func (c *Cors) LoadFromData(data CorsData) bool {
+	if len(data.AllowedMethods) <= 0 && len(data.AllowedOrigins) <= 0 && len(data.AllowedHeaders) <= 0 {
+		return false
+	}
+
+	if len(data.AllowedMethods) > 0 {
+		c.Data.AllowedMethods = data.AllowedMethods
+	}
+	if len(data.AllowedOrigins) > 0 {
+		c.Data.AllowedOrigins = data.AllowedOrigins
+	}
+	if len(data.AllowedHeaders) > 0 {
+		c.Data.AllowedHeaders = data.AllowedHeaders
+	}
+	c.Loaded = true
+
+	return true
+}
+
 func (c *Cors) String() string {
 	ret := ""
 
@@ -0,0 +1,417 @@
+package server
+
+import (
+	"encoding/xml"
+	"math"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DASH SegmentTemplate identifiers (the stream one is only for the config)
+const (
+	dashStreamVar         = "<stream>"
+	dashRepresentationVar = "$RepresentationID$"
+	dashNumberVar         = "$Number$"
+)
+
+// DASH MPD defaults
+const (
+	dashDefaultManifestName   = "manifest.mpd"
+	dashDefaultMedia          = "$RepresentationID$/seg_$Number$.m4s"
+	dashDefaultInitialization = "$RepresentationID$/init.mp4"
+	dashDefaultEndHeader      = "Stream-End"
+	dashMPDContentType        = "application/dash+xml"
+)
+
+// DASH Maintains dynamic MPDs from the lifecycle events of the SegmentTemplate segments of the configured streams
+type DASH struct {
+	config          *Config
+	waitingRequests *WaitingRequests
+	streams         []*dashStream
+	presentations   map[string]*dashPresentation
+	subscription    *EventSubscription
+	done            chan bool
+	lock            sync.Mutex
+}
+
+// DASHManifestInfo State of a MPD
+type DASHManifestInfo struct {
+	Key                   string    `json:"key"`
+	AvailabilityStartTime time.Time `json:"availabilityStartTime"`
+	StartNumber           int64     `json:"startNumber"`
+	LastNumber            int64     `json:"lastNumber"`
+	Ended                 bool      `json:"ended"`
+}
+
+type dashStream struct {
+	config DASHStreamConfig
+	re     *regexp.Regexp
+}
+
+// dashPresentation Live presentation of a stream, from its first segment
+type dashPresentation struct {
+	key                   string
+	stream                *dashStream
+	availabilityStartTime time.Time
+	startNumber           int64
+	lastNumber            int64
+	ended                 bool
+}
+
+// MPD elements written
+type dashMPD struct {
+	XMLName                   xml.Name                `xml:"MPD"`
+	Xmlns                     string                  `xml:"xmlns,attr"`
+	Profiles                  string                  `xml:"profiles,attr"`
+	Type                      string                  `xml:"type,attr"`
+	AvailabilityStartTime     string                  `xml:"availabilityStartTime,attr"`
+	PublishTime               string                  `xml:"publishTime,attr"`
+	MinimumUpdatePeriod       string                  `xml:"minimumUpdatePeriod,attr,omitempty"`
+	MediaPresentationDuration string                  `xml:"mediaPresentationDuration,attr,omitempty"`
+	MinBufferTime             string                  `xml:"minBufferTime,attr"`
+	TimeShiftBufferDepth      string                  `xml:"timeShiftBufferDepth,attr,omitempty"`
+	ServiceDescription        *dashServiceDescription `xml:"ServiceDescription,omitempty"`
+	Period                    dashPeriod              `xml:"Period"`
+	UTCTiming                 *dashUTCTiming          `xml:"UTCTiming,omitempty"`
+}
+
+type dashServiceDescription struct {
+	ID      string      `xml:"id,attr"`
+	Latency dashLatency `xml:"Latency"`
+}
+
+type dashLatency struct {
+	Target int64 `xml:"target,attr"`
+}
+
+type dashPeriod struct {
+	ID             string              `xml:"id,attr"`
+	Start          string              `xml:"start,attr"`
+	AdaptationSets []dashAdaptationSet `xml:"AdaptationSet"`
+}
+
+type dashAdaptationSet struct {
+	ID               string               `xml:"id,attr"`
+	ContentType      string               `xml:"contentType,attr,omitempty"`
+	MimeType         string               `xml:"mimeType,attr"`
+	SegmentAlignment bool                 `xml:"segmentAlignment,attr"`
+	StartWithSAP     int                  `xml:"startWithSAP,attr"`
+	SegmentTemplate  dashSegmentTemplate  `xml:"SegmentTemplate"`
+	Representations  []dashRepresentation `xml:"Representation"`
+}
+
+type dashSegmentTemplate struct {
+	Timescale                int64  `xml:"timescale,attr"`
+	Duration                 int64  `xml:"duration,attr"`
+	StartNumber              int64  `xml:"startNumber,attr"`
+	AvailabilityTimeOffset   string `xml:"availabilityTimeOffset,attr,omitempty"`
+	AvailabilityTimeComplete string `xml:"availabilityTimeComplete,attr,omitempty"`
+	Initialization           string `xml:"initialization,attr"`
+	Media                    string `xml:"media,attr"`
+}
+
+type dashRepresentation struct {
+	ID                string `xml:"id,attr"`
+	Bandwidth         int64  `xml:"bandwidth,attr"`
+	Codecs            string `xml:"codecs,attr,omitempty"`
+	Width             int    `xml:"width,attr,omitempty"`
+	Height            int    `xml:"height,attr,omitempty"`
+	AudioSamplingRate int    `xml:"audioSamplingRate,attr,omitempty"`
+}
+
+type dashUTCTiming struct {
+	SchemeIDURI string `xml:"schemeIdUri,attr"`
+	Value       string `xml:"value,attr"`
+}
+
+// NewDASH Creates a new DASH object, the defaults are applied to the streams
+func NewDASH(config *Config, waitingRequests *WaitingRequests) *DASH {
+	d := DASH{
+		config:          config,
+		waitingRequests: waitingRequests,
+		streams:         []*dashStream{},
+		presentations:   map[string]*dashPresentation{},
+	}
+	for _, streamConfig := range config.DASH.Streams {
+		d.streams = append(d.streams, newDASHStream(streamConfig))
+	}
+	if waitingRequests != nil && len(d.streams) > 0 {
+		waitingRequests.AddExpirationRule(d.getWaitExpiration)
+	}
+
+	return &d
+}
+
+// getWaitExpiration Returns how long a request for a segment number that did not start yet waits: a player asks
+// for it up to AvailabilityTimeOffsetS before it ends, plus one segment of clock drift (never less than the default)
+func (d *DASH) getWaitExpiration(key string) (time.Duration, bool) {
+	s, _, _, ok := d.match(key)
+	if !ok {
+		return 0, false
+	}
+	expiration := time.Duration((s.config.SegmentDurationS + s.config.AvailabilityTimeOffsetS) * float64(time.Second))
+	if expiration < d.waitingRequests.expiration {
+		expiration = d.waitingRequests.expiration
+	}
+	return expiration, true
+}
+
+func newDASHStream(config DASHStreamConfig) *dashStream {
+	if config.ManifestName == "" {
+		config.ManifestName = dashDefaultManifestName
+	}
+	if config.Media == "" {
+		config.Media = dashDefaultMedia
+	}
+	if config.Initialization == "" {
+		config.Initialization = dashDefaultInitialization
+	}
+	if config.AvailabilityTimeOffsetS <= 0 {
+		config.AvailabilityTimeOffsetS = config.SegmentDurationS
+	}
+	if config.EndHeader == "" {
+		config.EndHeader = dashDefaultEndHeader
+	}
+
+	// Ex: /dash/<stream>/$RepresentationID$/seg_$Number$.m4s -> ^/dash/(?P<s>[^/]+)/(?P<rep>[^/]+)/seg_(?P<n>\d+)\.m4s$
+	expr := regexp.QuoteMeta(config.Path + "/" + config.Media)
+	expr = strings.Replace(expr, dashStreamVar, `(?P<s>[^/]+)`, 1)
+	expr = strings.ReplaceAll(expr, dashStreamVar, `[^/]+`)
+	expr = strings.Replace(expr, regexp.QuoteMeta(dashRepresentationVar), `(?P<rep>[^/]+)`, 1)
+	expr = strings.ReplaceAll(expr, regexp.QuoteMeta(dashRepresentationVar), `[^/]+`)
+	expr = strings.Replace(expr, regexp.QuoteMeta(dashNumberVar), `(?P<n>\d+)`, 1)
+
+	return &dashStream{
+		config: config,
+		re:     regexp.MustCompile("^" + expr + "$"),
+	}
+}
+
+// Start Starts following the lifecycle events
+func (d *DASH) Start() {
+	d.subscription = objectEvents.SubscribeLossless("/")
+	d.done = make(chan bool)
+
+	go func() {
+		defer close(d.done)
+		for e := range d.subscription.C {
+			d.onEvent(e)
+		}
+	}()
+}
+
+// Stop Stops following the lifecycle events
+func (d *DASH) Stop() {
+	objectEvents.Unsubscribe(d.subscription)
+	<-d.done
+}
+
+// GetManifests Returns the state of every MPD
+func (d *DASH) GetManifests() []DASHManifestInfo {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	ret := []DASHManifestInfo{}
+	for _, p := range d.presentations {
+		ret = append(ret, DASHManifestInfo{
+			Key:                   p.key,
+			AvailabilityStartTime: p.availabilityStartTime,
+			StartNumber:           p.startNumber,
+			LastNumber:            p.lastNumber,
+			Ended:                 p.ended,
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Key < ret[j].Key
+	})
+
+	return ret
+}
+
+// End Declares the presentation of the MPD finished, returns false if the MPD does not exist
+func (d *DASH) End(key string) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	p, ok := d.presentations[key]
+	if !ok {
+		return false
+	}
+	if !p.ended {
+		p.ended = true
+		d.writeManifest(p)
+	}
+	return true
+}
+
+// match Returns the stream, MPD key and segment number of a segment key
+func (d *DASH) match(key string) (*dashStream, string, int64, bool) {
+	for _, s := range d.streams {
+		m := s.re.FindStringSubmatch(key)
+		if m == nil {
+			continue
+		}
+		number, err := strconv.ParseInt(m[s.re.SubexpIndex("n")], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		streamPath := s.config.Path
+		if i := s.re.SubexpIndex("s"); i > 0 {
+			streamPath = strings.ReplaceAll(streamPath, dashStreamVar, m[i])
+		}
+		return s, path.Join(streamPath, s.config.ManifestName), number, true
+	}
+
+	return nil, "", 0, false
+}
+
+func (d *DASH) onEvent(e ObjectEvent) {
+	s, manifestKey, number, ok := d.match(e.Key)
+	if !ok {
+		return
+	}
+
+	switch e.Type {
+	case EventCreated:
+		d.startSegment(s, manifestKey, number, e.ReceivedAt)
+	case EventFirstByte:
+		// The requests waiting for a future segment read it chunked while it is uploaded
+		if d.waitingRequests != nil {
+			d.waitingRequests.ReceivedDataFor(e.Key)
+		}
+	case EventCompleted:
+		if e.Headers.Get(s.config.EndHeader) != "" {
+			d.End(manifestKey)
+		}
+	}
+}
+
+// startSegment Creates the presentation on the first segment (or the first after the end), the segment number
+// starts at the availability start time
+func (d *DASH) startSegment(s *dashStream, manifestKey string, number int64, receivedAt time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	p, ok := d.presentations[manifestKey]
+	if ok && (!p.ended || number <= p.lastNumber) {
+		if number > p.lastNumber {
+			p.lastNumber = number
+		}
+		return
+	}
+
+	p = &dashPresentation{
+		key:                   manifestKey,
+		stream:                s,
+		availabilityStartTime: receivedAt,
+		startNumber:           number,
+		lastNumber:            number,
+	}
+	d.presentations[manifestKey] = p
+	d.writeManifest(p)
+}
+
+// writeManifest Replaces the MPD object with the current state, d.lock must be held
+func (d *DASH) writeManifest(p *dashPresentation) {
+	body, err := xml.MarshalIndent(p.getMPD(time.Now()), "", "  ")
+	if err != nil {
+		logWarnf("DASH %s error: %v", p.key, err)
+		return
+	}
+
+	writeManifest(d.waitingRequests, p.key, dashMPDContentType, append([]byte(xml.Header), body...))
+	logDebugf("DASH %s updated, start number %d", p.key, p.startNumber)
+}
+
+func (p *dashPresentation) getMPD(now time.Time) *dashMPD {
+	config := p.stream.config
+
+	mpd := &dashMPD{
+		Xmlns:                 "urn:mpeg:dash:schema:mpd:2011",
+		Profiles:              "urn:mpeg:dash:profile:isoff-live:2011",
+		Type:                  "dynamic",
+		AvailabilityStartTime: formatDASHTime(p.availabilityStartTime),
+		PublishTime:           formatDASHTime(now),
+		MinBufferTime:         formatDASHDuration(config.SegmentDurationS),
+		Period: dashPeriod{
+			ID:             "0",
+			Start:          formatDASHDuration(0),
+			AdaptationSets: []dashAdaptationSet{},
+		},
+	}
+	if p.ended {
+		// End of the live presentation, no more updates
+		mpd.MediaPresentationDuration = formatDASHDuration(float64(p.lastNumber-p.startNumber+1) * config.SegmentDurationS)
+	} else {
+		mpd.MinimumUpdatePeriod = formatDASHDuration(config.SegmentDurationS)
+	}
+	if config.TimeShiftBufferDepthS > 0 {
+		mpd.TimeShiftBufferDepth = formatDASHDuration(config.TimeShiftBufferDepthS)
+	}
+	if config.TargetLatencyMs > 0 {
+		mpd.ServiceDescription = &dashServiceDescription{
+			ID:      "0",
+			Latency: dashLatency{Target: config.TargetLatencyMs},
+		}
+	}
+	if config.UTCTimingURL != "" {
+		mpd.UTCTiming = &dashUTCTiming{
+			SchemeIDURI: "urn:mpeg:dash:utc:http-iso:2014",
+			Value:       config.UTCTimingURL,
+		}
+	}
+
+	// One adaptation set per mime type
+	template := dashSegmentTemplate{
+		Timescale:                1000,
+		Duration:                 int64(math.Round(config.SegmentDurationS * 1000)),
+		StartNumber:              p.startNumber,
+		AvailabilityTimeOffset:   strconv.FormatFloat(config.AvailabilityTimeOffsetS, 'f', -1, 64),
+		AvailabilityTimeComplete: "false",
+		Initialization:           config.Initialization,
+		Media:                    config.Media,
+	}
+	for _, rep := range config.Representations {
+		i := 0
+		for i < len(mpd.Period.AdaptationSets) && mpd.Period.AdaptationSets[i].MimeType != rep.MimeType {
+			i++
+		}
+		if i >= len(mpd.Period.AdaptationSets) {
+			mpd.Period.AdaptationSets = append(mpd.Period.AdaptationSets, dashAdaptationSet{
+				ID:               strconv.Itoa(i),
+				ContentType:      strings.Split(rep.MimeType, "/")[0],
+				MimeType:         rep.MimeType,
+				SegmentAlignment: true,
+				StartWithSAP:     1,
+				SegmentTemplate:  template,
+				Representations:  []dashRepresentation{},
+			})
+		}
+		mpd.Period.AdaptationSets[i].Representations = append(mpd.Period.AdaptationSets[i].Representations, dashRepresentation{
+			ID:                rep.ID,
+			Bandwidth:         rep.Bandwidth,
+			Codecs:            rep.Codecs,
+			Width:             rep.Width,
+			Height:            rep.Height,
+			AudioSamplingRate: rep.AudioSamplingRate,
+		})
+	}
+
+	return mpd
+}
+
+// formatDASHTime Returns the time as xs:dateTime in UTC with milliseconds
+func formatDASHTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+// formatDASHDuration Returns the seconds as xs:duration (Ex: PT2.5S)
+func formatDASHDuration(seconds float64) string {
+	return "PT" + strconv.FormatFloat(math.Round(seconds*1000)/1000, 'f', -1, 64) + "S"
+}
@@ -0,0 +1,24 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDASHWaitExpiration(t *testing.T) {
+	config := NewConfig()
+	config.DASH.Streams = []DASHStreamConfig{{Path: "/dash/<stream>", SegmentDurationS: 2, AvailabilityTimeOffsetS: 1.5}}
+	waitingRequests := NewWaitingRequests(time.Second, defaultRequestCleanUpEvery)
+	defer waitingRequests.Close()
+	NewDASH(config, waitingRequests)
+
+	for key, want := range map[string]time.Duration{
+		"/dash/a/720p/seg_5.m4s": 3500 * time.Millisecond,
+		"/dash/a/720p/init.mp4":  time.Second,
+		"/live/a/seg_5.ts":       time.Second,
+	} {
+		if got := waitingRequests.getDefaultExpiration(key); got != want {
+			t.Errorf("getDefaultExpiration(%q) = %v, want %v", key, got, want)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+)
+
+// Policies for the live readers that fall behind the writer
+const (
+	SlowReaderKeep       = "keep"
+	SlowReaderDisconnect = "disconnect"
+	SlowReaderSkip       = "skip"
+)
+
+var (
+	slowReaderDisconnects int64
+	slowReaderSkips       int64
+	egressWriteTimeouts   int64
+)
+
+// ReaderInfo Snapshot of a live reader
+type ReaderInfo struct {
+	Key      string  `json:"key"`
+	Offset   int64   `json:"offset"`
+	Size     int64   `json:"size"`
+	LagBytes int64   `json:"lagBytes"`
+	LagMs    float64 `json:"lagMs"`
+}
+
+// EgressStats Live readers and the slow reader counters
+type EgressStats struct {
+	Readers       []ReaderInfo `json:"readers"`
+	Disconnects   int64        `json:"disconnects"`
+	Skips         int64        `json:"skips"`
+	WriteTimeouts int64        `json:"writeTimeouts"`
+}
+
+// GetEgressStats Returns the lag of every reader reading from RAM and the slow reader counters
+func GetEgressStats() EgressStats {
+	FilesLock.RLock()
+	files := make([]*File, 0, len(Files))
+	for _, f := range Files {
+		files = append(files, f)
+	}
+	FilesLock.RUnlock()
+
+	stats := EgressStats{
+		Readers:       []ReaderInfo{},
+		Disconnects:   atomic.LoadInt64(&slowReaderDisconnects),
+		Skips:         atomic.LoadInt64(&slowReaderSkips),
+		WriteTimeouts: atomic.LoadInt64(&egressWriteTimeouts),
+	}
+	for _, f := range files {
+		for _, r := range f.GetLiveReaders() {
+			lagBytes, lagTime := r.GetLag()
+			offset := atomic.LoadInt64(&r.offset)
+			stats.Readers = append(stats.Readers, ReaderInfo{
+				Key:      f.Name,
+				Offset:   offset,
+				Size:     offset + lagBytes,
+				LagBytes: lagBytes,
+				LagMs:    float64(lagTime.Microseconds()) / 1000,
+			})
+		}
+	}
+
+	return stats
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
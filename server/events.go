@@ -0,0 +1,263 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Object lifecycle event types
+const (
+	EventCreated   = "created"
+	EventFirstByte = "firstByte"
+	EventCompleted = "completed"
+	EventFailed    = "failed"
+	EventDeleted   = "deleted"
+	EventExpired   = "expired"
+)
+
+// sseKeepAlive Time between SSE comments, so proxies do not close idle streams
+const sseKeepAlive = 15 * time.Second
+
+// objectEvents Bus where all the lifecycle points publish
+var objectEvents = NewEventBus()
+
+// ObjectEvent Lifecycle event of an object
+type ObjectEvent struct {
+	ID         int64       `json:"id"`
+	Type       string      `json:"type"`
+	Key        string      `json:"key"`
+	Size       int64       `json:"size"`
+	Time       time.Time   `json:"time"`
+	ReceivedAt time.Time   `json:"receivedAt"`
+	Headers    http.Header `json:"headers,omitempty"`
+}
+
+// EventBus Fans out the object lifecycle events to the subscribers, publishing never blocks
+type EventBus struct {
+	lastID        int64
+	subscriptions map[*EventSubscription]bool
+	lock          sync.Mutex
+}
+
+// EventSubscription Events of the keys under prefix, the ones that do not fit in the queue are dropped. Lossless
+// subscriptions never drop them (for the internal consumers whose state is built from every event)
+type EventSubscription struct {
+	C       chan ObjectEvent
+	prefix  string
+	dropped int64
+
+	// Lossless: unbounded queue moved to C by its own goroutine, protected by the EventBus lock
+	lossless bool
+	pending  []ObjectEvent
+	wakeUp   chan bool
+	closed   bool
+}
+
+// NewEventBus Creates a new EventBus object
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subscriptions: map[*EventSubscription]bool{},
+	}
+}
+
+// Subscribe Starts receiving the events of the keys under prefix
+func (eb *EventBus) Subscribe(prefix string, queueSize int) *EventSubscription {
+	s := &EventSubscription{
+		C:      make(chan ObjectEvent, queueSize),
+		prefix: prefix,
+	}
+
+	eb.lock.Lock()
+	eb.subscriptions[s] = true
+	eb.lock.Unlock()
+
+	return s
+}
+
+// SubscribeLossless Starts receiving the events of the keys under prefix, without ever dropping them
+func (eb *EventBus) SubscribeLossless(prefix string) *EventSubscription {
+	s := &EventSubscription{
+		C:        make(chan ObjectEvent),
+		prefix:   prefix,
+		lossless: true,
+		pending:  []ObjectEvent{},
+		wakeUp:   make(chan bool, 1),
+	}
+
+	eb.lock.Lock()
+	eb.subscriptions[s] = true
+	eb.lock.Unlock()
+
+	go eb.deliver(s)
+
+	return s
+}
+
+// deliver Moves the pending events of a lossless subscription to its channel, in order. Once it is closed the
+// pending ones are still delivered, then the channel is closed
+func (eb *EventBus) deliver(s *EventSubscription) {
+	defer close(s.C)
+
+	for {
+		eb.lock.Lock()
+		pending := s.pending
+		s.pending = []ObjectEvent{}
+		closed := s.closed
+		eb.lock.Unlock()
+
+		for _, e := range pending {
+			s.C <- e
+		}
+		if len(pending) > 0 {
+			continue
+		}
+		if closed {
+			return
+		}
+		<-s.wakeUp
+	}
+}
+
+// Unsubscribe Stops receiving events, the channel is closed
+func (eb *EventBus) Unsubscribe(s *EventSubscription) {
+	eb.lock.Lock()
+	defer eb.lock.Unlock()
+
+	if eb.subscriptions[s] {
+		delete(eb.subscriptions, s)
+		eb.closeSubscription(s)
+	}
+}
+
+// CloseSubscriptions Closes the channels of all the current subscriptions (used on shutdown)
+func (eb *EventBus) CloseSubscriptions() {
+	eb.lock.Lock()
+	defer eb.lock.Unlock()
+
+	for s := range eb.subscriptions {
+		eb.closeSubscription(s)
+	}
+	eb.subscriptions = map[*EventSubscription]bool{}
+}
+
+// closeSubscription Closes the channel, the lossless ones after the pending events. eb.lock must be held
+func (eb *EventBus) closeSubscription(s *EventSubscription) {
+	if !s.lossless {
+		close(s.C)
+		return
+	}
+	s.closed = true
+	s.wake()
+}
+
+// wake Signals the goroutine of a lossless subscription, never blocks
+func (s *EventSubscription) wake() {
+	select {
+	case s.wakeUp <- true:
+	default:
+	}
+}
+
+// Publish Sends the event to the matching subscriptions
+func (eb *EventBus) Publish(e ObjectEvent) {
+	eb.lock.Lock()
+	defer eb.lock.Unlock()
+
+	if len(eb.subscriptions) <= 0 {
+		return
+	}
+	eb.lastID++
+	e.ID = eb.lastID
+	for s := range eb.subscriptions {
+		if !strings.HasPrefix(e.Key, s.prefix) {
+			continue
+		}
+		if s.lossless {
+			s.pending = append(s.pending, e)
+			s.wake()
+			continue
+		}
+		select {
+		case s.C <- e:
+		default:
+			atomic.AddInt64(&s.dropped, 1)
+		}
+	}
+}
+
+// publishEvent Publishes a lifecycle event of f (none for the internal files), f.lock must NOT be held
+func publishEvent(eventType string, f *File) {
+	if f.internal {
+		return
+	}
+
+	f.lock.RLock()
+	e := ObjectEvent{
+		Type:       eventType,
+		Key:        f.Name,
+		Size:       f.size,
+		Time:       time.Now(),
+		ReceivedAt: f.receivedAt,
+		// A copy, the subscribers read it while the file goes on (and they could change it)
+		Headers: f.headers.Clone(),
+	}
+	f.lock.RUnlock()
+
+	objectEvents.Publish(e)
+}
+
+// EventsHandler Streams the lifecycle events of the keys under the prefix query param as Server-Sent Events
+func EventsHandler(queueSize int, cors *Cors, w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	s := objectEvents.Subscribe(r.URL.Query().Get("prefix"), queueSize)
+	defer objectEvents.Unsubscribe(s)
+
+	addCors(w, cors)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+
+	dropped := int64(0)
+	for {
+		select {
+		case e, ok := <-s.C:
+			if !ok {
+				return
+			}
+			if n := atomic.LoadInt64(&s.dropped); n > dropped {
+				logWarnf("EVENTS %d events dropped for slow subscriber %s", n-dropped, r.RemoteAddr)
+				dropped = n
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+			if err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			_, err := fmt.Fprint(w, ": keep-alive\n\n")
+			if err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
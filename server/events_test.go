@@ -0,0 +1,25 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPublishEventHeadersCopy(t *testing.T) {
+	s := objectEvents.Subscribe("/events/", 10)
+	defer objectEvents.Unsubscribe(s)
+
+	headers := http.Header{}
+	headers.Set("Content-Type", "video/mp2t")
+	f := NewFile("/events/a.ts", headers, -1)
+	select {
+	case e := <-s.C:
+		headers.Set("Content-Type", "text/plain")
+		if e.Type != EventCreated || e.Headers.Get("Content-Type") != "video/mp2t" {
+			t.Errorf("event = %s %v, want created with the headers when it was published", e.Type, e.Headers)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no event for %s", f.Name)
+	}
+}
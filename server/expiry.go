@@ -0,0 +1,392 @@
+package server
+
+import (
+	"container/heap"
+	"log"
+	"sync"
+	"time"
+)
+
+// fileExpiry Scheduler used by the ingest paths, nil if there is no clean up
+var fileExpiry *ExpiryScheduler = nil
+
+// ExpiryScheduler Removes the files when they are due. Due times are kept in a min-heap so only
+// the files that are actually due are touched, and the disk removal is done without holding FilesLock
+type ExpiryScheduler struct {
+	retention     *Retention
+	basePath      string
+	recheckPinned time.Duration
+
+	items   expiryHeap
+	index   map[*File]*expiryItem
+	groups  map[string]*expiryGroup
+	members map[*File]*expiryEntry
+	lock    sync.Mutex
+
+	wakeUp chan bool
+	exit   chan bool
+}
+
+type expiryItem struct {
+	at      time.Time
+	file    *File
+	heapIdx int
+}
+
+// expiryHeap Min-heap of items by due time
+type expiryHeap []*expiryItem
+
+// expiryGroup Files sharing the count / bytes limits of a retention rule, oldest first. The totals are kept
+// up to date, and the removed entries are skipped (dropped when they reach the front, or compacted), so adding
+// or removing a file does not walk the group
+type expiryGroup struct {
+	key     string
+	rule    *RetentionRule
+	entries []*expiryEntry
+	byName  map[string]*expiryEntry
+	count   int
+	bytes   int64
+	removed int
+}
+
+// expiryEntry File in a group, with the size and received time it was scheduled with
+type expiryEntry struct {
+	group      *expiryGroup
+	file       *File
+	size       int64
+	receivedAt time.Time
+	removed    bool
+}
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].heapIdx = i
+	h[j].heapIdx = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	item := x.(*expiryItem)
+	item.heapIdx = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return item
+}
+
+// scheduleExpiry Schedules the removal of a complete file (it should be called once the file is persisted)
+func scheduleExpiry(f *File) {
+	if fileExpiry != nil {
+		fileExpiry.Schedule(f)
+	}
+}
+
+// unscheduleExpiry Forgets a file removed by other means (Ex: DELETE), so it does not count in its group limits
+func unscheduleExpiry(f *File) {
+	if fileExpiry != nil {
+		fileExpiry.Unschedule(f)
+	}
+}
+
+// NewExpiryScheduler Creates a new ExpiryScheduler object
+func NewExpiryScheduler(retention *Retention, basePath string, recheckPinned time.Duration) *ExpiryScheduler {
+	return &ExpiryScheduler{
+		retention:     retention,
+		basePath:      basePath,
+		recheckPinned: recheckPinned,
+		items:         expiryHeap{},
+		index:         map[*File]*expiryItem{},
+		groups:        map[string]*expiryGroup{},
+		members:       map[*File]*expiryEntry{},
+		wakeUp:        make(chan bool, 1),
+		exit:          make(chan bool),
+	}
+}
+
+// Start Starts the scheduler thread
+func (es *ExpiryScheduler) Start() {
+	go es.run()
+
+	log.Printf("HTTP Started clean up thread")
+}
+
+// Stop Stops the scheduler thread and waits for it
+func (es *ExpiryScheduler) Stop() {
+	// Send finish signal
+	es.exit <- true
+
+	// Wait to finish
+	<-es.exit
+
+	log.Printf("HTTP Stopped clean up thread")
+}
+
+// Schedule Adds a complete file to the scheduler, according to the retention rule or its max-age
+func (es *ExpiryScheduler) Schedule(f *File) {
+	rule := es.retention.getRule(f.Name)
+
+	f.lock.RLock()
+	receivedAt := f.receivedAt
+	maxAgeS := f.maxAgeS
+	size := f.size
+	f.lock.RUnlock()
+
+	es.lock.Lock()
+	if rule == nil {
+		if es.retention.useMaxAge && maxAgeS >= 0 {
+			es.push(receivedAt.Add(time.Second*time.Duration(maxAgeS)), f)
+		}
+	} else {
+		if rule.MaxAgeS > 0 {
+			es.push(receivedAt.Add(rule.getMaxAge()), f)
+		}
+		if rule.hasGroupLimits() {
+			groupKey := rule.getGroupKey(f.Name)
+			group, exists := es.groups[groupKey]
+			if !exists {
+				group = &expiryGroup{key: groupKey, rule: rule, byName: map[string]*expiryEntry{}}
+				es.groups[groupKey] = group
+			}
+			if old, exists := group.byName[f.Name]; exists {
+				// Replaced by a new upload of the same key
+				es.removeEntry(old)
+			}
+			entry := &expiryEntry{group: group, file: f, size: size, receivedAt: receivedAt}
+			group.add(entry)
+			es.members[f] = entry
+			es.evaluateGroup(group, time.Now())
+		}
+	}
+	es.lock.Unlock()
+
+	// Next due could have changed
+	select {
+	case es.wakeUp <- true:
+	default:
+	}
+}
+
+// Unschedule Removes the file from the scheduler and from its group
+func (es *ExpiryScheduler) Unschedule(f *File) {
+	es.lock.Lock()
+	defer es.lock.Unlock()
+
+	if item, exists := es.index[f]; exists {
+		heap.Remove(&es.items, item.heapIdx)
+		delete(es.index, f)
+	}
+	if entry, exists := es.members[f]; exists {
+		es.removeEntry(entry)
+	}
+}
+
+func (es *ExpiryScheduler) run() {
+	timer := time.NewTimer(time.Hour)
+
+	for {
+		es.lock.Lock()
+		wait := time.Hour
+		if len(es.items) > 0 {
+			wait = time.Until(es.items[0].at)
+		}
+		es.lock.Unlock()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-timer.C:
+			es.expireDue(time.Now())
+		case <-es.wakeUp:
+		case <-es.exit:
+			timer.Stop()
+			// Indicates finished
+			es.exit <- true
+			log.Printf("HTTP Exited clean up thread")
+			return
+		}
+	}
+}
+
+// expireDue Removes all the due files
+func (es *ExpiryScheduler) expireDue(now time.Time) {
+	filesToDel := []*File{}
+
+	es.lock.Lock()
+	for len(es.items) > 0 && !es.items[0].at.After(now) {
+		item := heap.Pop(&es.items).(*expiryItem)
+		delete(es.index, item.file)
+
+		if item.file.IsPinned() {
+			es.push(now.Add(es.recheckPinned), item.file)
+			continue
+		}
+		entry, isMember := es.members[item.file]
+		if isMember && entry.group.rule.KeepLastN > 0 && entry.group.isInLastN(entry) {
+			// It will be scheduled again when newer files push it out of the last N
+			continue
+		}
+
+		FilesLock.Lock()
+		if Files[item.file.Name] == item.file {
+			delete(Files, item.file.Name)
+			filesToDel = append(filesToDel, item.file)
+		}
+		FilesLock.Unlock()
+
+		if isMember {
+			es.removeEntry(entry)
+		}
+	}
+	es.lock.Unlock()
+
+	// Disk removal without holding any lock
+	for _, f := range filesToDel {
+		if !es.retention.onlyRAM {
+			err := f.RemoveFromDisk(es.basePath)
+			if err != nil {
+				logWarnf("CLEANUP error removing %s from disk: %v", f.Name, err)
+			}
+		}
+		log.Printf("CLEANUP expired, deleted: %s", f.Name)
+		publishEvent(EventExpired, f)
+	}
+}
+
+// push Adds or moves (to the earliest time) the file in the heap, es.lock must be held
+func (es *ExpiryScheduler) push(at time.Time, f *File) {
+	if item, exists := es.index[f]; exists {
+		if at.Before(item.at) {
+			item.at = at
+			heap.Fix(&es.items, item.heapIdx)
+		}
+		return
+	}
+
+	item := &expiryItem{
+		at:   at,
+		file: f,
+	}
+	heap.Push(&es.items, item)
+	es.index[f] = item
+}
+
+// evaluateGroup Schedules now the oldest files of the group while it is over the limits, and the file that has
+// just left the last N if it is over the max age. es.lock must be held
+func (es *ExpiryScheduler) evaluateGroup(group *expiryGroup, now time.Time) {
+	rule := group.rule
+	for (rule.MaxObjects > 0 && group.count > rule.MaxObjects) || (rule.MaxTotalBytes > 0 && group.bytes > rule.MaxTotalBytes) {
+		entry := group.getOldest()
+		es.removeEntry(entry)
+		es.push(now, entry.file)
+	}
+
+	if rule.MaxAgeS > 0 {
+		if entry := group.getNewest(rule.KeepLastN); entry != nil && !entry.receivedAt.Add(rule.getMaxAge()).After(now) {
+			es.push(now, entry.file)
+		}
+	}
+}
+
+// removeEntry Removes the file from its group (and the group if it is empty). es.lock must be held
+func (es *ExpiryScheduler) removeEntry(entry *expiryEntry) {
+	if entry.removed {
+		return
+	}
+	group := entry.group
+	group.remove(entry)
+	if es.members[entry.file] == entry {
+		delete(es.members, entry.file)
+	}
+	if group.count <= 0 && es.groups[group.key] == group {
+		delete(es.groups, group.key)
+	}
+}
+
+// add Inserts the entry keeping the order by received time (usually at the end)
+func (g *expiryGroup) add(entry *expiryEntry) {
+	i := len(g.entries)
+	for i > 0 && g.entries[i-1].receivedAt.After(entry.receivedAt) {
+		i--
+	}
+	g.entries = append(g.entries, nil)
+	copy(g.entries[i+1:], g.entries[i:])
+	g.entries[i] = entry
+
+	g.byName[entry.file.Name] = entry
+	g.count++
+	g.bytes += entry.size
+}
+
+// remove Marks the entry as removed, the entries are compacted when most of them are removed
+func (g *expiryGroup) remove(entry *expiryEntry) {
+	entry.removed = true
+	if g.byName[entry.file.Name] == entry {
+		delete(g.byName, entry.file.Name)
+	}
+	g.count--
+	g.bytes -= entry.size
+	g.removed++
+
+	if g.removed > g.count {
+		entries := make([]*expiryEntry, 0, g.count)
+		for _, e := range g.entries {
+			if !e.removed {
+				entries = append(entries, e)
+			}
+		}
+		g.entries = entries
+		g.removed = 0
+	}
+}
+
+// getOldest Returns the oldest entry, dropping the removed ones in front (the group can not be empty)
+func (g *expiryGroup) getOldest() *expiryEntry {
+	for g.entries[0].removed {
+		g.entries[0] = nil
+		g.entries = g.entries[1:]
+		g.removed--
+	}
+	return g.entries[0]
+}
+
+// getNewest Returns the entry with n newer ones, nil if there is none
+func (g *expiryGroup) getNewest(n int) *expiryEntry {
+	for i := len(g.entries) - 1; i >= 0; i-- {
+		if g.entries[i].removed {
+			continue
+		}
+		if n == 0 {
+			return g.entries[i]
+		}
+		n--
+	}
+	return nil
+}
+
+// isInLastN Returns true if the entry is one of the newest KeepLastN of its group
+func (g *expiryGroup) isInLastN(entry *expiryEntry) bool {
+	n := g.rule.KeepLastN
+	for i := len(g.entries) - 1; i >= 0 && n > 0; i-- {
+		if g.entries[i].removed {
+			continue
+		}
+		if g.entries[i] == entry {
+			return true
+		}
+		n--
+	}
+	return false
+}
@@ -1,19 +1,31 @@
 package server
 
 import (
-	"fmt"
+	"errors"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var (
+	// ErrUploadFailed Returned to the readers of a file whose upload failed
+	ErrUploadFailed = errors.New("upload failed")
+
+	// ErrSlowReader Returned to the readers disconnected for being too far behind the writer
+	ErrSlowReader = errors.New("slow reader")
+
+	// ErrReaderGone Returned to the readers whose client went away while waiting for data
+	ErrReaderGone = errors.New("reader gone")
+
+	errInvalidSeek = errors.New("invalid seek")
+
 	// Files Array of on the fly files
 	Files = map[string]*File{}
 
@@ -23,101 +35,631 @@ var (
 
 // FileReader Defines a reader
 type FileReadCloser struct {
-	offset int
-	w      http.ResponseWriter
+	offset  int64
+	w       http.ResponseWriter
+	closed  bool
+	baseDir string
+	disk    *os.File
+	done    <-chan struct{}
+	egress  *EgressConfig
+	// joinedAt, joinLagBytes When the reader joined and the bytes it was behind then (less if it catches up),
+	// the data already there when it joined is not lag
+	joinedAt     time.Time
+	joinLagBytes int64
+	// chunkAligned Every read stops at the end of an ingested chunk
+	chunkAligned bool
 	*File
 }
 
-// Read Reads bytes from filereader
+// fileChunk Bytes received in one write, used to know how old the unread data is
+type fileChunk struct {
+	Offset int64
+	Size   int64
+	At     time.Time
+}
+
+// Read Reads bytes from filereader, blocking until there is new data or the file is complete
 func (r *FileReadCloser) Read(p []byte) (int, error) {
-	r.File.lock.RLock()
-	defer r.File.lock.RUnlock()
-	if r.offset >= len(r.File.buffer) {
+	if r.disk != nil {
+		n, err := r.disk.Read(p)
+		atomic.AddInt64(&r.offset, int64(n))
+		return n, err
+	}
+
+	for {
+		r.File.lock.RLock()
+		if r.File.failed {
+			r.File.lock.RUnlock()
+			return 0, ErrUploadFailed
+		}
+		offset := atomic.LoadInt64(&r.offset)
+		if r.File.onDisk {
+			// The buffer was moved to disk while reading, continue from there
+			r.File.lock.RUnlock()
+			err := r.openDisk(offset)
+			if err != nil {
+				return 0, err
+			}
+			return r.Read(p)
+		}
+		if offset < int64(len(r.File.buffer)) {
+			offset, err := r.applyLagPolicy(offset)
+			if err != nil {
+				r.File.lock.RUnlock()
+				return 0, err
+			}
+			end := int64(len(r.File.buffer))
+			if r.chunkAligned {
+				end = r.File.getChunkEnd(offset)
+			}
+			n := copy(p, r.File.buffer[offset:end])
+			atomic.StoreInt64(&r.offset, offset+int64(n))
+			r.File.lock.RUnlock()
+			// r.w.(http.Flusher).Flush()
+			return n, nil
+		}
 		if r.File.eof {
+			r.File.lock.RUnlock()
 			return 0, io.EOF
 		}
+		dataCh := r.File.dataCh
+		r.File.lock.RUnlock()
+
+		// Wait for new data (or the client to go away)
+		select {
+		case <-dataCh:
+		case <-r.done:
+			return 0, ErrReaderGone
+		}
+	}
+}
+
+// Seek Moves the next read to offset (only from the start), it can be beyond the data received so far
+func (r *FileReadCloser) Seek(offset int64, whence int) (int64, error) {
+	if whence != io.SeekStart || offset < 0 {
+		return 0, errInvalidSeek
+	}
+	if r.disk != nil {
+		n, err := r.disk.Seek(offset, whence)
+		atomic.StoreInt64(&r.offset, n)
+		return n, err
+	}
+
+	atomic.StoreInt64(&r.offset, offset)
+	return offset, nil
+}
+
+// Close Closes the reader (NOT the file, that is done by the writer)
+func (r *FileReadCloser) Close() error {
+	if !r.closed {
+		r.closed = true
+		r.File.removeReader(r)
+		if r.disk != nil {
+			r.disk.Close()
+		}
+	}
+	return nil
+}
+
+// GetLag Returns how many bytes, and how old is the oldest of them, the reader is behind the writer
+func (r *FileReadCloser) GetLag() (int64, time.Duration) {
+	r.File.lock.RLock()
+	defer r.File.lock.RUnlock()
+
+	return r.File.getLag(atomic.LoadInt64(&r.offset), time.Now())
+}
+
+// applyLagPolicy Disconnects or moves to the live edge the readers too far behind, File.lock must be held
+func (r *FileReadCloser) applyLagPolicy(offset int64) (int64, error) {
+	if r.egress == nil || r.egress.SlowReaderPolicy == SlowReaderKeep || r.File.eof {
+		return offset, nil
+	}
+
+	now := time.Now()
+	lagBytes, lagTime := r.File.getLag(offset, now)
+	if r.joinedAt.IsZero() {
+		r.joinedAt = now
+		r.joinLagBytes = lagBytes
+	}
+	if lagBytes < r.joinLagBytes {
+		r.joinLagBytes = lagBytes
+	}
+	// Only the readers that fall behind since they joined (or since they were closest to the live edge)
+	lagBytes -= r.joinLagBytes
+	if joined := now.Sub(r.joinedAt); lagTime > joined {
+		lagTime = joined
+	}
+	tooFar := (r.egress.MaxReaderLagBytes > 0 && lagBytes > r.egress.MaxReaderLagBytes) ||
+		(r.egress.MaxReaderLagMs > 0 && lagTime > time.Duration(r.egress.MaxReaderLagMs)*time.Millisecond)
+	if !tooFar {
+		return offset, nil
+	}
+
+	if r.egress.SlowReaderPolicy == SlowReaderDisconnect {
+		atomic.AddInt64(&slowReaderDisconnects, 1)
+		logWarnf("EGRESS %s slow reader disconnected, lag %d bytes %v", r.File.Name, lagBytes, lagTime)
+		return offset, ErrSlowReader
+	}
+
+	// Skip to the beginning of the last chunk received, only forward
+	liveEdge := r.File.chunks[len(r.File.chunks)-1].Offset
+	if liveEdge <= offset {
+		// Already reading the last chunk
+		return offset, nil
+	}
+	atomic.AddInt64(&slowReaderSkips, 1)
+	r.joinLagBytes = 0
+	logWarnf("EGRESS %s slow reader skipped %d bytes to the live edge", r.File.Name, liveEdge-offset)
+	return liveEdge, nil
+}
+
+func (r *FileReadCloser) openDisk(offset int64) error {
+	file, err := os.Open(path.Join(r.baseDir, r.File.Name))
+	if err != nil {
+		return err
+	}
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.disk = file
+	return nil
+}
+
+// diskReadCloser Reader of a file already written to disk
+type diskReadCloser struct {
+	*os.File
+	f      *File
+	closed bool
+}
 
-		return 0, nil
+// Close Closes the disk file
+func (r *diskReadCloser) Close() error {
+	if r.closed {
+		return nil
 	}
-	n := copy(p, r.File.buffer[r.offset:])
-	r.offset += n
-	// r.w.(http.Flusher).Flush()
-	return n, nil
+	r.closed = true
+	r.f.removeReader(nil)
+	return r.File.Close()
 }
 
 // File Definition of file
 type File struct {
-	Name       string
-	headers    http.Header
-	lock       *sync.RWMutex
-	buffer     []byte
-	eof        bool
-	onDisk     bool
-	receivedAt time.Time
-	maxAgeS    int64
+	Name        string
+	headers     http.Header
+	lock        *sync.RWMutex
+	buffer      []byte
+	eof         bool
+	onDisk      bool
+	receivedAt  time.Time
+	maxAgeS     int64
+	size        int64
+	pinned      bool
+	readers     int
+	failed      bool
+	lastWriteAt time.Time
+	dataCh      chan struct{}
+	chunks      []fileChunk
+	// chunksBase Chunks released once the file is on disk, chunks[0] then covers all of them
+	chunksBase  int
+	liveReaders map[*FileReadCloser]bool
+	metadata    map[string]string
+	index       mediaIndex
+	internal    bool
+}
+
+// FileInfo Snapshot of the state of a file
+type FileInfo struct {
+	Key        string            `json:"key"`
+	Size       int64             `json:"size"`
+	Complete   bool              `json:"complete"`
+	Failed     bool              `json:"failed"`
+	Storage    string            `json:"storage"`
+	Headers    http.Header       `json:"headers"`
+	ReceivedAt time.Time         `json:"receivedAt"`
+	MaxAgeS    int64             `json:"maxAgeS"`
+	ExpiresAt  *time.Time        `json:"expiresAt,omitempty"`
+	Pinned     bool              `json:"pinned"`
+	Readers    int               `json:"readers"`
+	Waiting    int               `json:"waiting"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
 }
 
 // NewFile Creates a new file
 func NewFile(name string, headers http.Header, maxAgeS int64) *File {
+	return newFile(name, headers, maxAgeS, false)
+}
+
+// newInternalFile Creates a new file generated by the server (playlists, MPDs), rewritten on every update so it
+// does NOT publish lifecycle events
+func newInternalFile(name string, headers http.Header, maxAgeS int64) *File {
+	return newFile(name, headers, maxAgeS, true)
+}
+
+func newFile(name string, headers http.Header, maxAgeS int64, internal bool) *File {
 	f := File{
-		Name:       name,
-		headers:    headers,
-		lock:       new(sync.RWMutex),
-		buffer:     []byte{},
-		eof:        false,
-		onDisk:     false,
-		receivedAt: time.Now(),
-		maxAgeS:    maxAgeS,
+		Name:        name,
+		headers:     headers,
+		lock:        new(sync.RWMutex),
+		buffer:      []byte{},
+		eof:         false,
+		onDisk:      false,
+		receivedAt:  time.Now(),
+		maxAgeS:     maxAgeS,
+		dataCh:      make(chan struct{}),
+		chunks:      []fileChunk{},
+		liveReaders: map[*FileReadCloser]bool{},
+		index:       newMediaIndex(name),
+		internal:    internal,
 	}
+	f.lastWriteAt = f.receivedAt
+	contentTypes.apply(name, f.headers)
 
 	contentType := f.GetContentType()
 
-	log.Println("NEW File Content-Type " + contentType)
+	logDebugf("NEW File %s Content-Type %s", name, contentType)
+	publishEvent(EventCreated, &f)
 
 	return &f
 }
 
 func (f *File) GetContentType() string {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
 	return f.headers.Get("Content-Type")
 }
 
-// NewReadCloser Crates a new filereader from a file
-func (f *File) NewReadCloser(baseDir string, w http.ResponseWriter) io.ReadCloser {
+// GetHeaders Returns a copy of the stored headers
+func (f *File) GetHeaders() http.Header {
 	f.lock.RLock()
 	defer f.lock.RUnlock()
 
+	return f.headers.Clone()
+}
+
+// getSize Returns the bytes received so far, and if the file is complete
+func (f *File) getSize() (int64, bool) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	return f.size, f.eof
+}
+
+// GetInfo Returns a snapshot of the file state
+func (f *File) GetInfo() FileInfo {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	info := FileInfo{
+		Key:        f.Name,
+		Size:       f.size,
+		Complete:   f.eof,
+		Failed:     f.failed,
+		Storage:    "ram",
+		Headers:    f.headers,
+		ReceivedAt: f.receivedAt,
+		MaxAgeS:    f.maxAgeS,
+		Pinned:     f.pinned,
+		Readers:    f.readers,
+		Metadata:   f.metadata,
+	}
+	if f.onDisk {
+		info.Storage = "disk"
+	}
+	if f.maxAgeS >= 0 && !f.pinned {
+		expiresAt := f.receivedAt.Add(time.Second * time.Duration(f.maxAgeS))
+		info.ExpiresAt = &expiresAt
+	}
+
+	return info
+}
+
+// SetMetadata Replaces the metadata attached by the hooks
+func (f *File) SetMetadata(metadata map[string]string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.metadata = map[string]string{}
+	for k, v := range metadata {
+		f.metadata[k] = v
+	}
+}
+
+// GetMetadata Returns a copy of the metadata attached by the hooks
+func (f *File) GetMetadata() map[string]string {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	ret := map[string]string{}
+	for k, v := range f.metadata {
+		ret[k] = v
+	}
+	return ret
+}
+
+// SetPinned Pinned files are never removed by the clean up
+func (f *File) SetPinned(pinned bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.pinned = pinned
+}
+
+// IsPinned Returns if the file is pinned
+func (f *File) IsPinned() bool {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	return f.pinned
+}
+
+// GetRAMBytes Returns the bytes of this file kept in RAM
+func (f *File) GetRAMBytes() int64 {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	return int64(len(f.buffer))
+}
+
+// GetLiveReaders Returns the readers reading from RAM
+func (f *File) GetLiveReaders() []*FileReadCloser {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	ret := make([]*FileReadCloser, 0, len(f.liveReaders))
+	for r := range f.liveReaders {
+		ret = append(ret, r)
+	}
+	return ret
+}
+
+func (f *File) removeReader(r *FileReadCloser) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.readers--
+	if r != nil {
+		delete(f.liveReaders, r)
+	}
+}
+
+// getLag Returns the bytes after offset and the age of the oldest of them, f.lock must be held
+func (f *File) getLag(offset int64, now time.Time) (int64, time.Duration) {
+	lagBytes := f.size - offset
+	if lagBytes <= 0 {
+		return 0, 0
+	}
+
+	i := sort.Search(len(f.chunks), func(i int) bool { return f.chunks[i].Offset+f.chunks[i].Size > offset })
+	if i >= len(f.chunks) {
+		return lagBytes, 0
+	}
+	return lagBytes, now.Sub(f.chunks[i].At)
+}
+
+// getChunkEnd Returns the end of the chunk that contains offset, f.lock must be held
+func (f *File) getChunkEnd(offset int64) int64 {
+	i := sort.Search(len(f.chunks), func(i int) bool { return f.chunks[i].Offset+f.chunks[i].Size > offset })
+	if i >= len(f.chunks) {
+		return f.size
+	}
+	return f.chunks[i].Offset + f.chunks[i].Size
+}
+
+// GetIndexInfo Returns a snapshot of the media index, false if the file is not indexed
+func (f *File) GetIndexInfo() (interface{}, bool) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	if f.index == nil {
+		return nil, false
+	}
+	return f.index.getInfo(), true
+}
+
+// getPartEnd Returns where a part that starts at start can end, at most at end: the end of the last complete
+// media unit if the file is indexed. Returns false if it can not end yet
+func (f *File) getPartEnd(start int64, end int64) (int64, bool) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	if f.index == nil {
+		return end, end > start
+	}
+	return f.index.getBoundary(start, end)
+}
+
+// getMediaDurationS Returns the duration (seconds) of the media units in [start, end) if the file is indexed,
+// timescales (by track ID) are used if the index does not know them (Ex: the ones of the fMP4 init segment)
+func (f *File) getMediaDurationS(start int64, end int64, timescales map[uint32]uint32) (float64, bool) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	if f.index == nil {
+		return 0, false
+	}
+	ticks, timescale, ok := f.index.getMediaTime(start, end, timescales)
+	if !ok || timescale == 0 {
+		return 0, false
+	}
+	return float64(ticks) / float64(timescale), true
+}
+
+// getIndexError Returns the error of the index, nil if the file is not indexed
+func (f *File) getIndexError() error {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	if f.index == nil {
+		return nil
+	}
+	return f.index.getError()
+}
+
+// isRandomAccess Returns true if the file is indexed and the media unit at offset can be decoded on its own
+func (f *File) isRandomAccess(offset int64) bool {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	return f.index != nil && f.index.isRandomAccess(offset)
+}
+
+// getKeyframeJoin Returns the bytes to send before the last keyframe and its offset, false if the file is
+// complete, not indexed or it has no keyframe yet
+func (f *File) getKeyframeJoin() ([]byte, int64, bool) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	if f.eof || f.index == nil {
+		return nil, 0, false
+	}
+	return f.index.getJoin()
+}
+
+// waitChunks Returns the chunks received after the first from ones, blocking until there are new ones or
+// the file is complete (returns true then). If some of them were released, the chunk that covers them is returned
+func (f *File) waitChunks(from int, done <-chan struct{}) ([]fileChunk, bool) {
+	for {
+		f.lock.RLock()
+		i := from - f.chunksBase
+		if i < 0 {
+			i = 0
+		}
+		if i < len(f.chunks) || f.eof {
+			var chunks []fileChunk
+			if i < len(f.chunks) {
+				chunks = append(chunks, f.chunks[i:]...)
+			}
+			eof := f.eof
+			f.lock.RUnlock()
+			return chunks, eof
+		}
+		dataCh := f.dataCh
+		f.lock.RUnlock()
+
+		select {
+		case <-dataCh:
+		case <-done:
+			return nil, true
+		}
+	}
+}
+
+// notify Wakes up the readers waiting for data, f.lock must be held
+func (f *File) notify() {
+	close(f.dataCh)
+	f.dataCh = make(chan struct{})
+}
+
+// OpenReadCloser Crates a new filereader from a file, returns error if the file is not on disk anymore
+func (f *File) OpenReadCloser(baseDir string, w http.ResponseWriter) (io.ReadCloser, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
 	if f.onDisk {
 		name := path.Join(baseDir, f.Name)
 		file, err := os.Open(name)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
-		fmt.Println("Skipping file reading and reading from disk")
-		return file
+		f.readers++
+		logDebugf("Reading %s from disk", f.Name)
+		return &diskReadCloser{
+			File: file,
+			f:    f,
+		}, nil
 	}
 
-	fmt.Println("Reading from memory")
-	return &FileReadCloser{
-		offset: 0,
-		w:      w,
-		File:   f,
+	f.readers++
+	logDebugf("Reading %s from memory", f.Name)
+	r := &FileReadCloser{
+		offset:  0,
+		w:       w,
+		baseDir: baseDir,
+		File:    f,
 	}
+	f.liveReaders[r] = true
+	return r, nil
 }
 
 // Close Closes a file
 func (f *File) Close() error {
 	f.lock.Lock()
-	defer f.lock.Unlock()
 	f.eof = true
+	f.notify()
+	f.lock.Unlock()
 
+	publishEvent(EventCompleted, f)
 	return nil
 }
 
-// Write Write bytes to a file
+// Fail Ends a file that will never be complete, live readers get ErrUploadFailed
+func (f *File) Fail() {
+	f.lock.Lock()
+	if f.failed {
+		f.lock.Unlock()
+		return
+	}
+	f.eof = true
+	f.failed = true
+	f.buffer = nil
+	f.notify()
+	f.lock.Unlock()
+
+	publishEvent(EventFailed, f)
+}
+
+// IsFailed Returns true if the upload of the file failed
+func (f *File) IsFailed() bool {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	return f.failed
+}
+
+func (f *File) getIngestTimes() (receivedAt time.Time, lastWriteAt time.Time) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	return f.receivedAt, f.lastWriteAt
+}
+
+// Write Write bytes to a file, it returns ErrUploadFailed once the file failed
 func (f *File) Write(p []byte) (int, error) {
 	f.lock.Lock()
-	defer f.lock.Unlock()
+	if f.failed {
+		f.lock.Unlock()
+		return 0, ErrUploadFailed
+	}
+	firstByte := f.size == 0 && len(p) > 0
+	if firstByte && f.headers.Get("Content-Type") == "" {
+		if contentType := contentTypes.detect(p); contentType != "" {
+			// Copy on write, the previous headers could be in use
+			headers := f.headers.Clone()
+			headers.Set("Content-Type", contentType)
+			f.headers = headers
+		}
+	}
+	if f.index != nil {
+		f.index.write(f.size, p)
+	}
+	now := time.Now()
+	f.chunks = append(f.chunks, fileChunk{
+		Offset: f.size,
+		Size:   int64(len(p)),
+		At:     now,
+	})
 	f.buffer = append(f.buffer, p...)
+	f.size += int64(len(p))
+	f.lastWriteAt = now
+	f.notify()
+	f.lock.Unlock()
+
+	if firstByte {
+		publishEvent(EventFirstByte, f)
+	}
 	return len(p), nil
 }
 
@@ -140,6 +682,12 @@ func (f *File) WriteToDisk(baseDir string) error {
 	}
 	f.onDisk = true
 	f.buffer = nil
+
+	// The readers continue from disk, one chunk is enough for the ones following the chunks (Ex: LL-HLS parts)
+	if n := len(f.chunks); n > 1 {
+		f.chunks = []fileChunk{{Offset: 0, Size: f.size, At: f.chunks[n-1].At}}
+		f.chunksBase += n - 1
+	}
 	return nil
 }
 
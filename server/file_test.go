@@ -0,0 +1,135 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// newLagTestReader Returns an in-progress file with a chunk of size bytes, and a reader of it with the policy
+func newLagTestReader(policy string, maxLagBytes int64, maxLagMs int64, size int) (*File, *FileReadCloser) {
+	f := NewFile("/lag.bin", http.Header{}, -1)
+	f.Write(make([]byte, size))
+	r := &FileReadCloser{
+		File: f,
+		egress: &EgressConfig{
+			SlowReaderPolicy:  policy,
+			MaxReaderLagBytes: maxLagBytes,
+			MaxReaderLagMs:    maxLagMs,
+		},
+	}
+	return f, r
+}
+
+func TestLagPolicyFromJoin(t *testing.T) {
+	f, r := newLagTestReader(SlowReaderDisconnect, 500, 0, 1000)
+
+	// The data already there when it joined is not lag
+	if offset, err := r.applyLagPolicy(0); err != nil || offset != 0 {
+		t.Fatalf("applyLagPolicy on join = %d %v, want 0 nil", offset, err)
+	}
+	f.Write(make([]byte, 400))
+	if _, err := r.applyLagPolicy(100); err != nil {
+		t.Fatalf("applyLagPolicy 300 bytes behind since the join = %v", err)
+	}
+	// Closer to the live edge, the reference is lower
+	if _, err := r.applyLagPolicy(1000); err != nil {
+		t.Fatalf("applyLagPolicy 400 bytes behind = %v", err)
+	}
+	f.Write(make([]byte, 600))
+	if _, err := r.applyLagPolicy(1000); err != ErrSlowReader {
+		t.Errorf("applyLagPolicy 1000 bytes behind (600 more than when it was closest) = %v, want ErrSlowReader", err)
+	}
+
+	// Complete files are never lagging
+	f.Close()
+	if _, err := r.applyLagPolicy(0); err != nil {
+		t.Errorf("applyLagPolicy on a complete file = %v", err)
+	}
+}
+
+func TestLagPolicyTime(t *testing.T) {
+	f, r := newLagTestReader(SlowReaderDisconnect, 0, 100, 10)
+	if _, err := r.applyLagPolicy(0); err != nil {
+		t.Fatalf("applyLagPolicy on join = %v", err)
+	}
+
+	// The chunks are old, but it only lags since it joined
+	old := time.Now().Add(-time.Hour)
+	f.chunks[0].At = old
+	f.Write(make([]byte, 10))
+	if _, err := r.applyLagPolicy(0); err != nil {
+		t.Fatalf("applyLagPolicy just after the join = %v", err)
+	}
+	r.joinedAt = old
+	if _, err := r.applyLagPolicy(0); err != ErrSlowReader {
+		t.Errorf("applyLagPolicy 1h behind = %v, want ErrSlowReader", err)
+	}
+	if _, err := r.applyLagPolicy(10); err != nil {
+		t.Errorf("applyLagPolicy on the last chunk = %v", err)
+	}
+}
+
+func TestLagPolicySkip(t *testing.T) {
+	f, r := newLagTestReader(SlowReaderSkip, 100, 0, 50)
+	r.applyLagPolicy(0)
+	f.Write(make([]byte, 100))
+	f.Write(make([]byte, 100))
+
+	// To the start of the last chunk, and the lag is counted from there
+	if offset, err := r.applyLagPolicy(10); err != nil || offset != 150 {
+		t.Fatalf("applyLagPolicy skip = %d %v, want 150 nil", offset, err)
+	}
+	if r.joinLagBytes != 0 {
+		t.Errorf("joinLagBytes after the skip = %d, want 0", r.joinLagBytes)
+	}
+
+	// Only forward, a reader too far behind in the last chunk stays there
+	f.Write(make([]byte, 200))
+	if offset, err := r.applyLagPolicy(260); err != nil || offset != 260 {
+		t.Errorf("applyLagPolicy in the last chunk = %d %v, want 260 nil", offset, err)
+	}
+}
+
+func TestLagPolicyKeep(t *testing.T) {
+	f, r := newLagTestReader(SlowReaderKeep, 1, 1, 10)
+	r.applyLagPolicy(0)
+	f.Write(make([]byte, 1000))
+	if offset, err := r.applyLagPolicy(0); err != nil || offset != 0 {
+		t.Errorf("applyLagPolicy keep = %d %v, want 0 nil", offset, err)
+	}
+}
+
+func TestWriteAfterFail(t *testing.T) {
+	f := NewFile("/failed.bin", http.Header{}, -1)
+	f.Write([]byte("data"))
+	f.Fail()
+	if n, err := f.Write([]byte("more")); n != 0 || err != ErrUploadFailed {
+		t.Errorf("Write after Fail = %d %v, want 0 ErrUploadFailed", n, err)
+	}
+	if size, complete := f.getSize(); size != 4 || !complete {
+		t.Errorf("getSize after Fail = %d %v, want 4 true", size, complete)
+	}
+}
+
+func TestChunksReleasedOnDisk(t *testing.T) {
+	f := NewFile("/disk/chunks.bin", http.Header{}, -1)
+	for i := 0; i < 3; i++ {
+		f.Write(make([]byte, 10))
+	}
+	f.Close()
+	if err := f.WriteToDisk(t.TempDir()); err != nil {
+		t.Fatalf("WriteToDisk = %v", err)
+	}
+	if len(f.chunks) != 1 || f.chunks[0].Size != 30 {
+		t.Fatalf("chunks on disk = %+v, want one of 30 bytes", f.chunks)
+	}
+
+	// A follower that is behind gets the chunk that covers the released ones, one at the end gets nothing
+	if chunks, eof := f.waitChunks(1, nil); len(chunks) != 1 || chunks[0].Offset+chunks[0].Size != 30 || !eof {
+		t.Errorf("waitChunks(1) = %+v %v, want the chunk up to 30", chunks, eof)
+	}
+	if chunks, eof := f.waitChunks(3, nil); len(chunks) != 0 || !eof {
+		t.Errorf("waitChunks(3) = %+v %v, want none", chunks, eof)
+	}
+}
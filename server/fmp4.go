@@ -0,0 +1,511 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// ISO BMFF sample flags
+const (
+	fmp4SampleIsNonSync = 0x00010000
+)
+
+// fmp4MaxBufferedBoxSize Max size of the moof / moov boxes, the only ones buffered to be parsed
+const fmp4MaxBufferedBoxSize = 16 << 20
+
+// FMP4Fragment moof / mdat pair of a fragmented MP4 object, Keyframe if its first sample is a sync sample. The
+// track, decode time and duration are the ones of its first track fragment
+type FMP4Fragment struct {
+	TrackID    uint32 `json:"trackId"`
+	MoofOffset int64  `json:"moofOffset"`
+	MoofSize   int64  `json:"moofSize"`
+	MdatOffset int64  `json:"mdatOffset"`
+	MdatSize   int64  `json:"mdatSize"`
+	Keyframe   bool   `json:"keyframe"`
+	DecodeTime uint64 `json:"decodeTime"`
+	Duration   uint64 `json:"duration"`
+	Complete   bool   `json:"complete"`
+}
+
+// FMP4IndexInfo Snapshot of the index of a fragmented MP4 object. InitSize are the bytes before the first
+// fragment (Ex: ftyp + moov, or styp), Timescale the one of the first track of its moov (0 if it has none)
+type FMP4IndexInfo struct {
+	Type      string         `json:"type"`
+	InitSize  int64          `json:"initSize"`
+	Timescale uint32         `json:"timescale,omitempty"`
+	Fragments []FMP4Fragment `json:"fragments"`
+	Error     string         `json:"error,omitempty"`
+}
+
+// fmp4Index Incremental parser of the top level boxes, only the moof and moov boxes are buffered
+type fmp4Index struct {
+	fragments  []FMP4Fragment
+	initSize   int64
+	timescale  uint32
+	timescales map[uint32]uint32
+
+	// Box being parsed
+	header    []byte
+	boxOffset int64
+	boxType   string
+	remaining int64
+	box       []byte
+
+	err error
+}
+
+func newFMP4Index() *fmp4Index {
+	return &fmp4Index{
+		fragments: []FMP4Fragment{},
+		header:    make([]byte, 0, 16),
+	}
+}
+
+func (idx *fmp4Index) write(offset int64, p []byte) {
+	for len(p) > 0 && idx.err == nil {
+		if idx.boxType == "" {
+			n := idx.readHeader(offset, p)
+			offset += int64(n)
+			p = p[n:]
+			continue
+		}
+
+		n := len(p)
+		if idx.remaining >= 0 && int64(n) > idx.remaining {
+			n = int(idx.remaining)
+		}
+		if idx.box != nil {
+			idx.box = append(idx.box, p[:n]...)
+		}
+		offset += int64(n)
+		p = p[n:]
+		if idx.remaining < 0 {
+			// Box until the end of the object
+			continue
+		}
+		idx.remaining -= int64(n)
+		if idx.remaining == 0 {
+			idx.endBox()
+		}
+	}
+}
+
+// readHeader Reads the header of the next box, returns the bytes used
+func (idx *fmp4Index) readHeader(offset int64, p []byte) int {
+	if len(idx.header) == 0 {
+		idx.boxOffset = offset
+	}
+	headerSize := 8
+	if len(idx.header) >= 4 && binary.BigEndian.Uint32(idx.header[:4]) == 1 {
+		headerSize = 16
+	}
+	n := min(headerSize-len(idx.header), len(p))
+	idx.header = append(idx.header, p[:n]...)
+	if len(idx.header) < 8 {
+		return n
+	}
+	if binary.BigEndian.Uint32(idx.header[:4]) == 1 && len(idx.header) < 16 {
+		// 64 bits size
+		if n >= len(p) {
+			return n
+		}
+		return n + idx.readHeader(offset+int64(n), p[n:])
+	}
+
+	size := int64(binary.BigEndian.Uint32(idx.header[:4]))
+	if size == 1 {
+		size = int64(binary.BigEndian.Uint64(idx.header[8:16]))
+	}
+	idx.boxType = string(idx.header[4:8])
+	switch {
+	case size == 0:
+		idx.remaining = -1
+	case size < int64(len(idx.header)):
+		idx.err = fmt.Errorf("invalid box %q size %d at %d", idx.boxType, size, idx.boxOffset)
+		return n
+	default:
+		idx.remaining = size - int64(len(idx.header))
+	}
+	idx.startBox(size)
+
+	idx.header = idx.header[:0]
+	if idx.remaining == 0 {
+		idx.endBox()
+	}
+	return n
+}
+
+func (idx *fmp4Index) startBox(size int64) {
+	if (idx.boxType == "moof" || idx.boxType == "moov") && (size == 0 || size > fmp4MaxBufferedBoxSize) {
+		// It would be buffered whole (or until the end of the object)
+		idx.err = fmt.Errorf("box %q size %d at %d, the max is %d", idx.boxType, size, idx.boxOffset, fmp4MaxBufferedBoxSize)
+		return
+	}
+
+	switch idx.boxType {
+	case "moof":
+		idx.box = append([]byte(nil), idx.header...)
+		idx.fragments = append(idx.fragments, FMP4Fragment{
+			MoofOffset: idx.boxOffset,
+			MoofSize:   size,
+		})
+	case "mdat":
+		if last := len(idx.fragments) - 1; last >= 0 && idx.fragments[last].MdatOffset == 0 {
+			idx.fragments[last].MdatOffset = idx.boxOffset
+			idx.fragments[last].MdatSize = size
+		}
+	default:
+		if len(idx.fragments) == 0 {
+			idx.initSize = idx.boxOffset + size
+		}
+		if idx.boxType == "moov" {
+			idx.box = append([]byte(nil), idx.header...)
+		}
+	}
+}
+
+func (idx *fmp4Index) endBox() {
+	last := len(idx.fragments) - 1
+	switch idx.boxType {
+	case "moof":
+		if last >= 0 {
+			frag := &idx.fragments[last]
+			frag.Keyframe, frag.DecodeTime = parseMoof(idx.box)
+			if payload, ok := findBox(idx.box, "moof"); ok {
+				if traf, ok := findBox(payload, "traf"); ok {
+					frag.TrackID = getTrafTrackID(traf)
+					frag.Duration = getTrafDuration(traf)
+				}
+			}
+		}
+	case "moov":
+		idx.timescales, idx.timescale = getFMP4Timescales(idx.box)
+	case "mdat":
+		if last >= 0 && idx.fragments[last].MdatOffset == idx.boxOffset {
+			idx.fragments[last].Complete = true
+		}
+	}
+	idx.box = nil
+	idx.boxType = ""
+}
+
+func (idx *fmp4Index) getBoundary(start int64, end int64) (int64, bool) {
+	ret := int64(-1)
+	for _, frag := range idx.fragments {
+		fragEnd := frag.MdatOffset + frag.MdatSize
+		if !frag.Complete || fragEnd <= start {
+			continue
+		}
+		if fragEnd > end {
+			break
+		}
+		ret = fragEnd
+	}
+	return ret, ret > start
+}
+
+// isRandomAccess Returns true if a fragment that starts with a keyframe starts at offset
+func (idx *fmp4Index) isRandomAccess(offset int64) bool {
+	i := sort.Search(len(idx.fragments), func(i int) bool { return idx.fragments[i].MoofOffset >= offset })
+	return i < len(idx.fragments) && idx.fragments[i].MoofOffset == offset && idx.fragments[i].Keyframe
+}
+
+// getMediaTime Returns the sample durations of the complete fragments in [start, end) of the track of the first
+// one, and the timescale of that track (from the moov of the object, or else from timescales)
+func (idx *fmp4Index) getMediaTime(start int64, end int64, timescales map[uint32]uint32) (uint64, uint32, bool) {
+	total := uint64(0)
+	found := false
+	trackID := uint32(0)
+	for _, frag := range idx.fragments {
+		if frag.MoofOffset < start || !frag.Complete {
+			continue
+		}
+		if frag.MoofOffset >= end {
+			break
+		}
+		if !found {
+			trackID = frag.TrackID
+		} else if frag.TrackID != trackID {
+			continue
+		}
+		total += frag.Duration
+		found = true
+	}
+
+	timescale, ok := idx.timescales[trackID]
+	if !ok {
+		timescale = timescales[trackID]
+	}
+	return total, timescale, found
+}
+
+// getJoin Not supported, the fMP4 players need the init segment and start on a segment or part boundary
+func (idx *fmp4Index) getJoin() ([]byte, int64, bool) {
+	return nil, 0, false
+}
+
+func (idx *fmp4Index) getError() error {
+	if idx.err != nil {
+		return fmt.Errorf("%w: %v", errInvalidMedia, idx.err)
+	}
+	return nil
+}
+
+func (idx *fmp4Index) getInfo() interface{} {
+	info := FMP4IndexInfo{
+		Type:      "fmp4",
+		InitSize:  idx.initSize,
+		Timescale: idx.timescale,
+		Fragments: append([]FMP4Fragment{}, idx.fragments...),
+	}
+	if idx.err != nil {
+		info.Error = idx.err.Error()
+	}
+	return info
+}
+
+// parseMoof Returns if the first sample of the first track fragment is a sync sample, and its decode time
+func parseMoof(moof []byte) (keyframe bool, decodeTime uint64) {
+	payload, ok := findBox(moof, "moof")
+	if !ok {
+		return false, 0
+	}
+	traf, ok := findBox(payload, "traf")
+	if !ok {
+		return false, 0
+	}
+
+	sampleFlags := uint32(fmp4SampleIsNonSync)
+	if tfhd, ok := findBox(traf, "tfhd"); ok && len(tfhd) >= 8 {
+		flags := binary.BigEndian.Uint32(tfhd[:4]) & 0xFFFFFF
+		pos := 8
+		for _, field := range []struct {
+			flag uint32
+			size int
+		}{{0x01, 8}, {0x02, 4}, {0x08, 4}, {0x10, 4}} {
+			if flags&field.flag != 0 {
+				pos += field.size
+			}
+		}
+		if flags&0x20 != 0 && len(tfhd) >= pos+4 {
+			sampleFlags = binary.BigEndian.Uint32(tfhd[pos:])
+		}
+	}
+	if tfdt, ok := findBox(traf, "tfdt"); ok && len(tfdt) >= 8 {
+		if tfdt[0] == 1 && len(tfdt) >= 12 {
+			decodeTime = binary.BigEndian.Uint64(tfdt[4:12])
+		} else {
+			decodeTime = uint64(binary.BigEndian.Uint32(tfdt[4:8]))
+		}
+	}
+	if trun, ok := findBox(traf, "trun"); ok && len(trun) >= 8 {
+		flags := binary.BigEndian.Uint32(trun[:4]) & 0xFFFFFF
+		pos := 8
+		if flags&0x01 != 0 {
+			// data_offset
+			pos += 4
+		}
+		if flags&0x04 != 0 && len(trun) >= pos+4 {
+			sampleFlags = binary.BigEndian.Uint32(trun[pos:])
+		} else if flags&0x400 != 0 {
+			if flags&0x100 != 0 {
+				pos += 4
+			}
+			if flags&0x200 != 0 {
+				pos += 4
+			}
+			if len(trun) >= pos+4 {
+				sampleFlags = binary.BigEndian.Uint32(trun[pos:])
+			}
+		}
+	}
+
+	return sampleFlags&fmp4SampleIsNonSync == 0, decodeTime
+}
+
+// findBox Returns the payload of the first child box of the type
+func findBox(b []byte, boxType string) ([]byte, bool) {
+	for {
+		t, payload, rest, ok := nextBox(b)
+		if !ok {
+			return nil, false
+		}
+		if t == boxType {
+			return payload, true
+		}
+		b = rest
+	}
+}
+
+// nextBox Returns the type and payload of the first box in b, and the bytes after it
+func nextBox(b []byte) (string, []byte, []byte, bool) {
+	if len(b) < 8 {
+		return "", nil, nil, false
+	}
+	size := int64(binary.BigEndian.Uint32(b[:4]))
+	headerSize := int64(8)
+	if size == 1 && len(b) >= 16 {
+		size = int64(binary.BigEndian.Uint64(b[8:16]))
+		headerSize = 16
+	} else if size == 0 {
+		size = int64(len(b))
+	}
+	if size < headerSize || size > int64(len(b)) {
+		return "", nil, nil, false
+	}
+	return string(b[4:8]), b[headerSize:size], b[size:], true
+}
+
+// getFMP4Timescales Returns the timescales of the tracks of an init segment (moov / trak / mdia / mdhd) by their
+// track_ID (tkhd), and the one of the first track. nil if it has none
+func getFMP4Timescales(init []byte) (map[uint32]uint32, uint32) {
+	moov, ok := findBox(init, "moov")
+	if !ok {
+		return nil, 0
+	}
+
+	var timescales map[uint32]uint32
+	first := uint32(0)
+	for b := moov; ; {
+		boxType, trak, rest, ok := nextBox(b)
+		if !ok {
+			break
+		}
+		b = rest
+		if boxType != "trak" {
+			continue
+		}
+		tkhd, ok := findBox(trak, "tkhd")
+		if !ok {
+			continue
+		}
+		// Version 1 has 64 bits creation / modification times, in tkhd and mdhd
+		trackID, ok := getFullBoxUint32(tkhd, 12, 20)
+		if !ok {
+			continue
+		}
+		mdia, ok := findBox(trak, "mdia")
+		if !ok {
+			continue
+		}
+		mdhd, ok := findBox(mdia, "mdhd")
+		if !ok {
+			continue
+		}
+		timescale, ok := getFullBoxUint32(mdhd, 12, 20)
+		if !ok || timescale == 0 {
+			continue
+		}
+
+		if timescales == nil {
+			timescales = map[uint32]uint32{}
+			first = timescale
+		}
+		timescales[trackID] = timescale
+	}
+	return timescales, first
+}
+
+// getFullBoxUint32 Returns the uint32 of a full box payload at pos0 if it is version 0, or at pos1 if version 1
+func getFullBoxUint32(payload []byte, pos0 int, pos1 int) (uint32, bool) {
+	if len(payload) < 4 {
+		return 0, false
+	}
+	pos := pos0
+	if payload[0] == 1 {
+		pos = pos1
+	}
+	if len(payload) < pos+4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(payload[pos:]), true
+}
+
+// getTrafTrackID Returns the track_ID of a track fragment (tfhd), 0 if it has none
+func getTrafTrackID(traf []byte) uint32 {
+	if tfhd, ok := findBox(traf, "tfhd"); ok && len(tfhd) >= 8 {
+		return binary.BigEndian.Uint32(tfhd[4:8])
+	}
+	return 0
+}
+
+// getFMP4Duration Returns the duration (seconds) of the samples of the first track fragment of every moof, with the
+// timescale of its track (from the init segment). 0 if it is unknown
+func getFMP4Duration(data []byte, timescales map[uint32]uint32) float64 {
+	total := float64(0)
+	for {
+		boxType, payload, rest, ok := nextBox(data)
+		if !ok {
+			break
+		}
+		if boxType == "moof" {
+			if traf, ok := findBox(payload, "traf"); ok {
+				if timescale := timescales[getTrafTrackID(traf)]; timescale > 0 {
+					total += float64(getTrafDuration(traf)) / float64(timescale)
+				}
+			}
+		}
+		data = rest
+	}
+	return total
+}
+
+// getTrafDuration Returns the sum of the sample durations (trun, or the tfhd default) of a track fragment
+func getTrafDuration(traf []byte) uint64 {
+	defaultDuration := uint64(0)
+	if tfhd, ok := findBox(traf, "tfhd"); ok && len(tfhd) >= 8 {
+		flags := binary.BigEndian.Uint32(tfhd[:4]) & 0xFFFFFF
+		pos := 8
+		if flags&0x01 != 0 {
+			// base_data_offset
+			pos += 8
+		}
+		if flags&0x02 != 0 {
+			// sample_description_index
+			pos += 4
+		}
+		if flags&0x08 != 0 && len(tfhd) >= pos+4 {
+			defaultDuration = uint64(binary.BigEndian.Uint32(tfhd[pos:]))
+		}
+	}
+
+	total := uint64(0)
+	for b := traf; ; {
+		boxType, trun, rest, ok := nextBox(b)
+		if !ok {
+			break
+		}
+		b = rest
+		if boxType != "trun" || len(trun) < 8 {
+			continue
+		}
+		flags := binary.BigEndian.Uint32(trun[:4]) & 0xFFFFFF
+		count := int(binary.BigEndian.Uint32(trun[4:8]))
+		pos := 8
+		if flags&0x01 != 0 {
+			// data_offset
+			pos += 4
+		}
+		if flags&0x04 != 0 {
+			// first_sample_flags
+			pos += 4
+		}
+		if flags&0x100 == 0 {
+			total += uint64(count) * defaultDuration
+			continue
+		}
+		// Duration, size, flags and composition time offset of every sample
+		sampleSize := 0
+		for _, flag := range []uint32{0x100, 0x200, 0x400, 0x800} {
+			if flags&flag != 0 {
+				sampleSize += 4
+			}
+		}
+		for i := 0; i < count && len(trun) >= pos+4; i++ {
+			total += uint64(binary.BigEndian.Uint32(trun[pos:]))
+			pos += sampleSize
+		}
+	}
+	return total
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"testing"
+)
+
+// mp4Box Returns a box with the payload
+func mp4Box(boxType string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+	b := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(b, uint32(size))
+	copy(b[4:], boxType)
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func be32(values ...uint32) []byte {
+	b := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint32(b[4*i:], v)
+	}
+	return b
+}
+
+// testMP4Trak Returns a trak with the track ID and timescale
+func testMP4Trak(trackID uint32, timescale uint32) []byte {
+	// Version 0: creation / modification time, track ID (tkhd) or timescale (mdhd), ...
+	tkhd := mp4Box("tkhd", be32(0, 0, 0, trackID, 0, 0))
+	mdhd := mp4Box("mdhd", be32(0, 0, 0, timescale, 0))
+	return mp4Box("trak", tkhd, mp4Box("mdia", mdhd))
+}
+
+// testMP4Init Returns ftyp + moov with the traks, a track 1 of the timescale if there are none
+func testMP4Init(timescale uint32, traks ...[]byte) []byte {
+	if len(traks) == 0 {
+		traks = [][]byte{testMP4Trak(1, timescale)}
+	}
+	return append(mp4Box("ftyp", []byte("iso6"), be32(0)), mp4Box("moov", traks...)...)
+}
+
+// testMP4Fragment Returns a moof / mdat pair of the track 1 with samples of sampleDuration, the first one a sync
+// sample if keyframe
+func testMP4Fragment(decodeTime uint64, samples uint32, sampleDuration uint32, keyframe bool) []byte {
+	return testMP4TrackFragment(1, decodeTime, samples, sampleDuration, keyframe)
+}
+
+func testMP4TrackFragment(trackID uint32, decodeTime uint64, samples uint32, sampleDuration uint32, keyframe bool) []byte {
+	firstSampleFlags := uint32(fmp4SampleIsNonSync)
+	if keyframe {
+		firstSampleFlags = 0
+	}
+	// tfhd with default_sample_duration, tfdt version 1, trun with data_offset and first_sample_flags
+	tfhd := mp4Box("tfhd", be32(0x08, trackID, sampleDuration))
+	tfdt := mp4Box("tfdt", be32(1<<24, uint32(decodeTime>>32), uint32(decodeTime)))
+	trun := mp4Box("trun", be32(0x01|0x04, samples, 0, firstSampleFlags))
+	moof := mp4Box("moof", mp4Box("mfhd", be32(0, 1)), mp4Box("traf", tfhd, tfdt, trun))
+	return append(moof, mp4Box("mdat", make([]byte, 100))...)
+}
+
+// writeInPieces Writes data to the index in pieces of n bytes
+func writeInPieces(idx mediaIndex, data []byte, n int) {
+	for offset := 0; offset < len(data); offset += n {
+		end := min(offset+n, len(data))
+		idx.write(int64(offset), data[offset:end])
+	}
+}
+
+func TestFMP4Index(t *testing.T) {
+	init := testMP4Init(1000)
+	frag1 := testMP4Fragment(0, 3, 1000, true)
+	frag2 := testMP4Fragment(3000, 2, 1000, false)
+	data := append(append(append([]byte{}, init...), frag1...), frag2...)
+
+	idx := newFMP4Index()
+	writeInPieces(idx, data, 7)
+	if err := idx.getError(); err != nil {
+		t.Fatalf("getError = %v", err)
+	}
+
+	info := idx.getInfo().(FMP4IndexInfo)
+	if info.InitSize != int64(len(init)) || info.Timescale != 1000 {
+		t.Errorf("initSize %d timescale %d, want %d 1000", info.InitSize, info.Timescale, len(init))
+	}
+	if len(info.Fragments) != 2 {
+		t.Fatalf("%d fragments, want 2", len(info.Fragments))
+	}
+	frag1Offset := int64(len(init))
+	frag2Offset := frag1Offset + int64(len(frag1))
+	want := []FMP4Fragment{
+		{MoofOffset: frag1Offset, MoofSize: int64(len(frag1) - 108), MdatOffset: frag2Offset - 108, MdatSize: 108, Keyframe: true, DecodeTime: 0, Duration: 3000, Complete: true, TrackID: 1},
+		{MoofOffset: frag2Offset, MoofSize: int64(len(frag2) - 108), MdatOffset: int64(len(data)) - 108, MdatSize: 108, Keyframe: false, DecodeTime: 3000, Duration: 2000, Complete: true, TrackID: 1},
+	}
+	for i := range want {
+		if info.Fragments[i] != want[i] {
+			t.Errorf("fragment %d = %+v, want %+v", i, info.Fragments[i], want[i])
+		}
+	}
+
+	// Only the exact start of a keyframe fragment
+	for _, tt := range []struct {
+		offset int64
+		want   bool
+	}{{0, false}, {frag1Offset, true}, {frag1Offset + 1, false}, {frag2Offset, false}} {
+		if got := idx.isRandomAccess(tt.offset); got != tt.want {
+			t.Errorf("isRandomAccess(%d) = %v, want %v", tt.offset, got, tt.want)
+		}
+	}
+
+	if end, ok := idx.getBoundary(0, int64(len(data))-1); !ok || end != frag2Offset {
+		t.Errorf("getBoundary before the end = %d %v, want %d", end, ok, frag2Offset)
+	}
+	if end, ok := idx.getBoundary(frag2Offset, int64(len(data))); !ok || end != int64(len(data)) {
+		t.Errorf("getBoundary of the last fragment = %d %v, want %d", end, ok, len(data))
+	}
+	if _, ok := idx.getBoundary(frag2Offset, int64(len(data))-1); ok {
+		t.Errorf("getBoundary without complete fragments is ok")
+	}
+
+	if ticks, timescale, ok := idx.getMediaTime(0, int64(len(data)), nil); !ok || ticks != 5000 || timescale != 1000 {
+		t.Errorf("getMediaTime = %d %d %v, want 5000 1000", ticks, timescale, ok)
+	}
+	if ticks, _, ok := idx.getMediaTime(frag2Offset, int64(len(data)), nil); !ok || ticks != 2000 {
+		t.Errorf("getMediaTime of the last fragment = %d %v, want 2000", ticks, ok)
+	}
+
+	if _, _, ok := idx.getJoin(); ok {
+		t.Errorf("getJoin is ok, it is only supported for TS")
+	}
+}
+
+func TestFMP4IndexIncomplete(t *testing.T) {
+	frag1 := testMP4Fragment(0, 3, 1000, true)
+	frag2 := testMP4Fragment(3000, 2, 1000, true)
+	data := append(append([]byte{}, frag1...), frag2[:len(frag2)-50]...)
+
+	idx := newFMP4Index()
+	writeInPieces(idx, data, 64)
+
+	// The segment (without moov) does not know the timescale, and the incomplete fragment is not counted
+	ticks, timescale, ok := idx.getMediaTime(0, int64(len(data)), nil)
+	if !ok || ticks != 3000 || timescale != 0 {
+		t.Errorf("getMediaTime = %d %d %v, want 3000 0", ticks, timescale, ok)
+	}
+	// The one of its track in the init segment
+	if _, timescale, _ := idx.getMediaTime(0, int64(len(data)), map[uint32]uint32{2: 48000, 1: 90000}); timescale != 90000 {
+		t.Errorf("getMediaTime timescale with the init ones = %d, want 90000", timescale)
+	}
+	if end, ok := idx.getBoundary(0, int64(len(data))); !ok || end != int64(len(frag1)) {
+		t.Errorf("getBoundary = %d %v, want %d", end, ok, len(frag1))
+	}
+	if !idx.isRandomAccess(int64(len(frag1))) {
+		t.Errorf("isRandomAccess of the incomplete keyframe fragment = false")
+	}
+}
+
+func TestFMP4IndexInvalidBox(t *testing.T) {
+	idx := newFMP4Index()
+	idx.write(0, be32(4, 0x66747970))
+	if err := idx.getError(); !errors.Is(err, errInvalidMedia) {
+		t.Errorf("getError = %v, want errInvalidMedia", err)
+	}
+
+	// The moof / moov boxes are buffered, they can not be unbounded or too big
+	for _, header := range [][]byte{be32(0, 0x6d6f6f66), be32(fmp4MaxBufferedBoxSize+1, 0x6d6f6f76), be32(1, 0x6d6f6f66, 1, 0)} {
+		idx := newFMP4Index()
+		idx.write(0, header)
+		if err := idx.getError(); !errors.Is(err, errInvalidMedia) {
+			t.Errorf("getError of the box %x = %v, want errInvalidMedia", header, err)
+		}
+	}
+}
+
+func TestFMP4IndexTrackTimescale(t *testing.T) {
+	// The fragments are of the track 1, the second trak
+	init := testMP4Init(0, testMP4Trak(2, 48000), testMP4Trak(1, 90000))
+	data := append(append([]byte{}, init...), testMP4Fragment(0, 25, 3600, true)...)
+
+	idx := newFMP4Index()
+	writeInPieces(idx, data, 100)
+	if info := idx.getInfo().(FMP4IndexInfo); info.Timescale != 48000 {
+		t.Errorf("info timescale = %d, want the first track 48000", info.Timescale)
+	}
+	if ticks, timescale, ok := idx.getMediaTime(0, int64(len(data)), nil); !ok || ticks != 90000 || timescale != 90000 {
+		t.Errorf("getMediaTime = %d %d %v, want 90000 90000", ticks, timescale, ok)
+	}
+}
+
+func TestFMP4Duration(t *testing.T) {
+	init := testMP4Init(0, testMP4Trak(1, 90000), testMP4Trak(2, 48000))
+	timescales, first := getFMP4Timescales(init)
+	if first != 90000 || len(timescales) != 2 || timescales[2] != 48000 {
+		t.Fatalf("getFMP4Timescales = %v %d, want 1: 90000 2: 48000", timescales, first)
+	}
+	if timescales, _ := getFMP4Timescales(mp4Box("ftyp")); timescales != nil {
+		t.Errorf("getFMP4Timescales without moov = %v", timescales)
+	}
+
+	// Every fragment with the timescale of its track
+	data := append(testMP4Fragment(0, 25, 3600, true), testMP4TrackFragment(2, 0, 48, 1000, true)...)
+	if got := getFMP4Duration(data, timescales); math.Abs(got-2) > 1e-9 {
+		t.Errorf("getFMP4Duration = %f, want 2", got)
+	}
+	if got := getFMP4Duration(data, nil); got != 0 {
+		t.Errorf("getFMP4Duration without timescales = %f, want 0", got)
+	}
+}
+
+func TestTrafDurationPerSample(t *testing.T) {
+	// trun with the sample duration and size of every sample
+	trun := mp4Box("trun", be32(0x100|0x200, 3, 1000, 10, 2000, 10, 500, 10))
+	traf := append(mp4Box("tfhd", be32(0, 1)), trun...)
+	if got := getTrafDuration(traf); got != 3500 {
+		t.Errorf("getTrafDuration = %d, want 3500", got)
+	}
+}
@@ -1,41 +1,212 @@
 package server
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
-// ChunkedResponseWriter Define a response writer
+// joinParam Query param with the join mode of a GET, JoinKeyframe starts in-progress TS objects on the last keyframe
+const (
+	joinParam    = "join"
+	JoinKeyframe = "keyframe"
+)
+
+// ChunkedResponseWriter Define a response writer, every write is flushed (one chunk in HTTP/1.1, DATA frames in HTTP/2)
 type ChunkedResponseWriter struct {
-	w http.ResponseWriter
+	w            http.ResponseWriter
+	rc           *http.ResponseController
+	writeTimeout time.Duration
 }
 
 // Write Writes few bytes
 func (rw ChunkedResponseWriter) Write(p []byte) (nn int, err error) {
+	if rw.rc != nil && rw.writeTimeout > 0 {
+		// Per stream in HTTP/2, so one slow stream does not affect the others of the connection
+		rw.rc.SetWriteDeadline(time.Now().Add(rw.writeTimeout))
+	}
 	nn, err = rw.w.Write(p)
 	rw.w.(http.Flusher).Flush()
 	return
 }
 
 // GetHandler Sends file bytes
-func GetHandler(waitingRequests *WaitingRequests, cors *Cors, basePath string, w http.ResponseWriter, r *http.Request) {
+func GetHandler(waitingRequests *WaitingRequests, upstream *Upstream, egress EgressConfig, cors *Cors, basePath string, w http.ResponseWriter, r *http.Request) {
 	name := r.URL.String()
+	join := r.URL.Query().Get(joinParam)
+	if join != "" {
+		if join != JoinKeyframe {
+			addCors(w, cors)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		// The join mode is not part of the object key
+		name = getKeyWithout(r.URL, joinParam)
+	}
+
+	f, ok := getFileForRead(waitingRequests, upstream, name, w, r)
+	if !ok {
+		addCors(w, cors)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	hookCtx := newHookContext(name, r, f.GetHeaders(), f.GetMetadata())
+	if err := getHooks().OnRead(hookCtx); err != nil {
+		addCors(w, cors)
+		w.WriteHeader(getHookErrorStatus(err))
+		return
+	}
+	addCors(w, cors)
+	addHeaders(w, name, hookCtx.Headers)
+
+	// Single byte ranges, also on in-progress objects (Ex: LL-HLS byte range parts)
+	status := http.StatusOK
+	var rng *byteRange = nil
+	w.Header().Set("Accept-Ranges", "bytes")
+	if br, ok := parseRange(r.Header.Get("Range")); ok {
+		size, complete := f.getSize()
+		resolved, ok := br.resolve(size, complete)
+		if !ok {
+			if complete {
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			}
+			// In progress, the suffix ranges can not be resolved until the final size is known
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		total := int64(-1)
+		if complete {
+			total = size
+		}
+		resolved.setContentRange(w, total)
+		rng = &resolved
+		status = http.StatusPartialContent
+	}
+
+	// Keyframe join on in-progress TS objects, starts on the last keyframe with the PAT / PMT in front
+	var joinPrefix []byte = nil
+	joinOffset := int64(0)
+	if join == JoinKeyframe && rng == nil {
+		if prefix, offset, ok := f.getKeyframeJoin(); ok {
+			joinPrefix = prefix
+			joinOffset = offset
+		}
+	}
+
+	// Add chunked only if the file is not yet complete (HTTP/2 has its own framing)
+	if !f.eof && r.ProtoMajor == 1 {
+		w.Header().Set("Transfer-Encoding", "chunked")
+	}
 
+	rc, ok := openForRead(f, basePath, w)
+	if !ok {
+		return
+	}
+	defer rc.Close()
+	if frc, fromRAM := rc.(*FileReadCloser); !fromRAM {
+		getAccessLogEntry(r).Source = "disk"
+	} else {
+		if getAccessLogEntry(r).Source == "" {
+			getAccessLogEntry(r).Source = "ram"
+		}
+		if rng == nil && joinPrefix == nil {
+			// Skipping to the live edge would break the byte addressing of the ranges (and the joined keyframe)
+			frc.egress = &egress
+		}
+		frc.done = r.Context().Done()
+	}
+	var src io.Reader = rc
+	if rng != nil {
+		if _, err := rc.(io.Seeker).Seek(rng.Start, io.SeekStart); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if length := rng.getLength(); length >= 0 {
+			src = io.LimitReader(rc, length)
+		}
+	} else if joinPrefix != nil {
+		if _, err := rc.(io.Seeker).Seek(joinOffset, io.SeekStart); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		src = io.MultiReader(bytes.NewReader(joinPrefix), rc)
+	}
+
+	crw := ChunkedResponseWriter{
+		w:            w,
+		rc:           http.NewResponseController(w),
+		writeTimeout: time.Duration(egress.WriteTimeoutMs) * time.Millisecond,
+	}
+	if crw.writeTimeout > 0 {
+		// The connection can be reused by the next request
+		defer crw.rc.SetWriteDeadline(time.Time{})
+	}
+
+	w.WriteHeader(status)
+	n, err := io.Copy(crw, src)
+	if isTimeout(err) {
+		atomic.AddInt64(&egressWriteTimeouts, 1)
+		logWarnf("EGRESS %s write timeout", name)
+	}
+	if err == ErrUploadFailed || err == ErrSlowReader {
+		// Abort the response, so the client does not take it as complete
+		panic(http.ErrAbortHandler)
+	}
+	if err == nil && rng != nil && rng.getLength() >= 0 && n < rng.getLength() {
+		// The object completed before the last byte of the Content-Range sent, abort instead of a short 206
+		logWarnf("EGRESS %s range %d-%d ended after %d bytes", name, rng.Start, rng.End, n)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// getKeyWithout Returns the key of the URL without the query parameter
+func getKeyWithout(u *url.URL, param string) string {
+	query := u.Query()
+	if !query.Has(param) {
+		return u.String()
+	}
+
+	query.Del(param)
+	ret := *u
+	ret.RawQuery = query.Encode()
+	return ret.String()
+}
+
+// getFileForRead Returns the file, pulling it from upstream or waiting for it if it is not present yet
+func getFileForRead(waitingRequests *WaitingRequests, upstream *Upstream, name string, w http.ResponseWriter, r *http.Request) (*File, bool) {
 	FilesLock.RLock()
 	f, ok := Files[name]
 	FilesLock.RUnlock()
 
+	if !ok && upstream != nil {
+		// Edge mode, all the misses for the same name share one upstream request
+		f, ok = upstream.Pull(r.Context(), name, r.Header)
+		if ok {
+			getAccessLogEntry(r).Source = "upstream"
+		} else if r.Context().Err() != nil {
+			// The client is gone, no need to wait for the object
+			return nil, false
+		}
+	}
+
 	if !ok {
 		isFound := false
 		waited := 0 * time.Millisecond
 		if waitingRequests != nil {
-			// Wait and return
-			isFound, waited = waitingRequests.AddWaitingRequest(name, getHeadersFiltered(r.Header))
+			// Wait and return. The header policy only applies to the stored headers, the request Expires
+			// must reach the waiting logic whatever Headers.Allow / Deny are
+			isFound, waited = waitingRequests.AddWaitingRequest(name, r.Header)
+			getAccessLogEntry(r).WaitedMs = float64(waited) / float64(time.Millisecond)
 			w.Header().Set("Waited-For-Data-Ms", strconv.FormatInt(int64(waited/time.Millisecond), 10))
 			if isFound {
 				// Refresh file
@@ -51,21 +222,11 @@ func GetHandler(waitingRequests *WaitingRequests, cors *Cors, basePath string, w
 			}
 		}
 		if !isFound {
-			addCors(w, cors)
-			w.WriteHeader(http.StatusNotFound)
-			return
+			return nil, false
 		}
 	}
-	addCors(w, cors)
-	addHeaders(w, f.headers)
 
-	// Add chunked only if the file is not yet complete
-	if !f.eof {
-		w.Header().Set("Transfer-Encoding", "chunked")
-	}
-
-	w.WriteHeader(http.StatusOK)
-	io.Copy(ChunkedResponseWriter{w}, f.NewReadCloser(basePath, w))
+	return f, true
 }
 
 // HeadHandler Sends if file exists
@@ -80,30 +241,94 @@ func HeadHandler(cors *Cors, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	addHeaders(w, f.headers)
-	w.Header().Set("Transfer-Encoding", "chunked")
+	addHeaders(w, f.Name, f.GetHeaders())
+	if r.ProtoMajor == 1 {
+		w.Header().Set("Transfer-Encoding", "chunked")
+	}
 
 	w.WriteHeader(http.StatusOK)
 }
 
 // PostHandler Writes a file
-func PostHandler(waitingRequests *WaitingRequests, onlyRAM bool, cors *Cors, basePath string, w http.ResponseWriter, r *http.Request) {
+func PostHandler(waitingRequests *WaitingRequests, replicator *Replicator, ingest IngestConfig, onlyRAM bool, cors *Cors, basePath string, w http.ResponseWriter, r *http.Request) {
 	// TODO: Add trigger blocking requests reusing/coping the code in Get
 	name := r.URL.String()
 
 	maxAgeS := getMaxAgeOr(r.Header.Get("Cache-Control"), -1)
 	headers := getHeadersFiltered(r.Header)
 
-	f := NewFile(name, headers, maxAgeS)
+	hooks := getHooks()
+	hookCtx := newHookContext(name, r, headers, nil)
+	if err := hooks.OnUploadStart(hookCtx); err != nil {
+		logWarnf("INGEST %s rejected by hook: %v", name, err)
+		addCors(w, cors)
+		w.WriteHeader(getHookErrorStatus(err))
+		return
+	}
+
+	f := NewFile(name, hookCtx.Headers, maxAgeS)
+	f.SetMetadata(hookCtx.Metadata)
 
 	FilesLock.Lock()
 	Files[name] = f
 	FilesLock.Unlock()
 
+	var replicationUpload *ReplicationUpload = nil
+	if replicator != nil && !isReplicaUpload(r) {
+		replicationUpload = replicator.StartUpload(r.Method, f, r.Header)
+	}
+
+	// Stalled uploads are aborted
+	watchdog := watchIngest(f, time.Duration(ingest.IdleTimeoutMs)*time.Millisecond, time.Duration(ingest.MaxDurationMs)*time.Millisecond, func(err error) {
+		logWarnf("INGEST %s aborted: %v", name, err)
+		abortRequestBody(r)
+	})
+
 	// Start writing to file without holding lock so that GET requests can read from it
-	io.Copy(f, r.Body)
+	var dst io.Writer = f
+	if replicationUpload != nil {
+		dst = io.MultiWriter(f, replicationUpload)
+	}
+	_, errCopy := io.Copy(newChunkHookWriter(hooks, hookCtx, dst), r.Body)
+	errTimeout := watchdog.Stop()
 	r.Body.Close()
+
+	if errCopy == nil && isReplicaAborted(r) {
+		// The source failed it, whatever the local policy is
+		errCopy = errReplicationAborted
+	}
+	if errCopy == nil {
+		errCopy = checkMediaIndex(f)
+	}
+	hookStatus := getHookAbortStatus(errCopy)
+	if errCopy != nil && (ingest.OnAbort == IngestPolicyFail || hookStatus != 0 || errCopy == errReplicationAborted || errors.Is(errCopy, errInvalidMedia) || errors.Is(errCopy, ErrUploadFailed)) {
+		// Interrupted, stalled or rejected, it will never be complete
+		failUpload(f)
+		if replicationUpload != nil {
+			replicationUpload.Abort()
+		}
+		logWarnf("INGEST %s failed: %v", name, errCopy)
+
+		addCors(w, cors)
+		if hookStatus != 0 {
+			w.WriteHeader(hookStatus)
+		} else if errTimeout != nil {
+			w.WriteHeader(http.StatusRequestTimeout)
+		} else if errors.Is(errCopy, ErrUploadFailed) {
+			// Expired (or failed) by the admin API while in progress
+			w.WriteHeader(http.StatusGone)
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		return
+	}
 	f.Close()
+	hooks.OnUploadComplete(hookCtx)
+	f.SetMetadata(hookCtx.Metadata)
+
+	if replicationUpload != nil {
+		replicationUpload.Close()
+	}
 
 	if !onlyRAM {
 		err := f.WriteToDisk(basePath)
@@ -111,6 +336,7 @@ func PostHandler(waitingRequests *WaitingRequests, onlyRAM bool, cors *Cors, bas
 			log.Fatalf("Error saving to disk: %v", err)
 		}
 	}
+	scheduleExpiry(f)
 	addCors(w, cors)
 	w.WriteHeader(http.StatusNoContent)
 
@@ -121,8 +347,8 @@ func PostHandler(waitingRequests *WaitingRequests, onlyRAM bool, cors *Cors, bas
 }
 
 // PutHandler Writes a file
-func PutHandler(waitingRequests *WaitingRequests, onlyRAM bool, cors *Cors, basePath string, w http.ResponseWriter, r *http.Request) {
-	PostHandler(waitingRequests, onlyRAM, cors, basePath, w, r)
+func PutHandler(waitingRequests *WaitingRequests, replicator *Replicator, ingest IngestConfig, onlyRAM bool, cors *Cors, basePath string, w http.ResponseWriter, r *http.Request) {
+	PostHandler(waitingRequests, replicator, ingest, onlyRAM, cors, basePath, w, r)
 }
 
 // DeleteHandler Deletes a file
@@ -136,21 +362,34 @@ func DeleteHandler(onlyRAM bool, cors *Cors, basePath string, w http.ResponseWri
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
+	if err := getHooks().OnDelete(newHookContext(f.Name, r, f.GetHeaders(), f.GetMetadata())); err != nil {
+		w.WriteHeader(getHookErrorStatus(err))
+		return
+	}
 
 	FilesLock.Lock()
-	delete(Files, r.URL.String())
+	if Files[f.Name] == f {
+		delete(Files, f.Name)
+	}
 	FilesLock.Unlock()
+	unscheduleExpiry(f)
 
 	if !onlyRAM {
-		f.RemoveFromDisk(basePath)
+		err := f.RemoveFromDisk(basePath)
+		if err != nil {
+			logWarnf("Error removing %s from disk: %v", f.Name, err)
+		}
 	}
+	publishEvent(EventDeleted, f)
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
 // OptionsHandler Returns CORS options
 func OptionsHandler(cors *Cors, w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Transfer-Encoding", "chunked")
+	if r.ProtoMajor == 1 {
+		w.Header().Set("Transfer-Encoding", "chunked")
+	}
 
 	addCors(w, cors)
 	w.WriteHeader(http.StatusNoContent)
@@ -169,14 +408,49 @@ func addCors(w http.ResponseWriter, cors *Cors) {
 	w.Header().Set("Access-Control-Expose-Headers", strings.Join(allowedHeaders, ", "))
 }
 
-func addHeaders(w http.ResponseWriter, headersSrc http.Header) {
+// addHeaders Replays the stored headers (all their values) and applies the response rules of key
+func addHeaders(w http.ResponseWriter, key string, headersSrc http.Header) {
 	// Copy all headers
 	for name, values := range headersSrc {
+		if !headerPolicy.IsStored(name) {
+			continue
+		}
+		// Stored values replace the ones already set
+		w.Header().Del(name)
 		// Loop over all values for the name.
 		for _, value := range values {
-			w.Header().Set(name, value)
+			w.Header().Add(name, value)
 		}
 	}
+
+	headerPolicy.applyResponseRules(key, w.Header())
+}
+
+// openForRead Opens a reader of f, if it fails answers 404 (removed from disk meanwhile) or 500
+func openForRead(f *File, basePath string, w http.ResponseWriter) (io.ReadCloser, bool) {
+	rc, err := f.OpenReadCloser(basePath, w)
+	if err != nil {
+		logWarnf("EGRESS %s error opening: %v", f.Name, err)
+		w.Header().Del("Content-Range")
+		if os.IsNotExist(err) {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return nil, false
+	}
+	return rc, true
+}
+
+// failUpload Marks the file as failed and removes it
+func failUpload(f *File) {
+	f.Fail()
+
+	FilesLock.Lock()
+	if Files[f.Name] == f {
+		delete(Files, f.Name)
+	}
+	FilesLock.Unlock()
 }
 
 func getMaxAgeOr(s string, def int64) int64 {
@@ -198,10 +472,5 @@ func getMaxAgeOr(s string, def int64) int64 {
 }
 
 func getHeadersFiltered(headers http.Header) http.Header {
-	ret := headers.Clone()
-
-	// Clean up
-	ret.Del("User-Agent")
-
-	return ret
+	return headerPolicy.Filter(headers)
 }
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+// defaultDeniedHeaders Request headers never stored by default: credentials, hop-by-hop, and the ones that
+// describe the upload request (not the object)
+var defaultDeniedHeaders = []string{
+	"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "Host", "User-Agent", "Content-Length", "Expect",
+	"Connection", "Keep-Alive", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+	"Accept", "Accept-Encoding", "Accept-Language", "Origin", "Referer", "Forwarded", "Via",
+	"X-Forwarded-*", "X-Real-Ip", "Sec-*",
+}
+
+// headerPolicy Policy used by the ingest and egress paths, replaced by StartHTTPServer with the configured one
+var headerPolicy = NewHeaderPolicy(NewConfig().Headers)
+
+// HeaderPolicy Decides which upload headers are stored and replayed, and the headers set per path in the responses
+type HeaderPolicy struct {
+	allow     []string
+	deny      []string
+	responses []ResponseHeadersRule
+}
+
+// NewHeaderPolicy Creates a new HeaderPolicy object
+func NewHeaderPolicy(config HeadersConfig) *HeaderPolicy {
+	hp := HeaderPolicy{
+		allow:     []string{},
+		deny:      []string{},
+		responses: config.Responses,
+	}
+	for _, pattern := range config.Allow {
+		hp.allow = append(hp.allow, strings.ToLower(pattern))
+	}
+	for _, pattern := range config.Deny {
+		hp.deny = append(hp.deny, strings.ToLower(pattern))
+	}
+
+	return &hp
+}
+
+// IsStored Returns true if the header is allowed (all are if there is no allowlist) and not denied
+func (hp *HeaderPolicy) IsStored(name string) bool {
+	// Never stored, they would leak credentials or loop the replication
+	if strings.EqualFold(name, "Authorization") || strings.EqualFold(name, ReplicatedHeader) {
+		return false
+	}
+
+	name = strings.ToLower(name)
+	if len(hp.allow) > 0 && !matchesHeader(hp.allow, name) {
+		return false
+	}
+	return !matchesHeader(hp.deny, name)
+}
+
+// Filter Returns a copy of headers with only the ones to store, keeping all their values
+func (hp *HeaderPolicy) Filter(headers http.Header) http.Header {
+	ret := http.Header{}
+	for name, values := range headers {
+		if hp.IsStored(name) {
+			ret[http.CanonicalHeaderKey(name)] = append([]string(nil), values...)
+		}
+	}
+
+	return ret
+}
+
+// applyResponseRules Sets the headers of all the rules that match key, in order (an empty value removes the header)
+func (hp *HeaderPolicy) applyResponseRules(key string, headers http.Header) {
+	for _, rule := range hp.responses {
+		if !matchesKey(rule.Match, key) {
+			continue
+		}
+		for name, value := range rule.Set {
+			if value == "" {
+				headers.Del(name)
+			} else {
+				headers.Set(name, value)
+			}
+		}
+	}
+}
+
+// matchesHeader Patterns (lower case) ending in * are prefixes
+func matchesHeader(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "*") {
+			if strings.HasPrefix(name, strings.TrimSuffix(pattern, "*")) {
+				return true
+			}
+		} else if pattern == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync/atomic"
+
+	"github.com/gorilla/mux"
+)
+
+// Health Liveness and readiness endpoints (for load balancers and k8s probes)
+type Health struct {
+	config   *Config
+	draining int32
+}
+
+// ReadinessStatus Readiness response
+type ReadinessStatus struct {
+	Ready           bool   `json:"ready"`
+	Draining        bool   `json:"draining"`
+	StorageWritable bool   `json:"storageWritable"`
+	StorageError    string `json:"storageError,omitempty"`
+	RAMBytes        int64  `json:"ramBytes"`
+	RAMBudgetBytes  int64  `json:"ramBudgetBytes"`
+}
+
+// NewHealth Creates a new Health object
+func NewHealth(config *Config) *Health {
+	return &Health{
+		config: config,
+	}
+}
+
+// AddRoutes Adds the liveness and readiness endpoints
+func (h *Health) AddRoutes(r *mux.Router) {
+	r.HandleFunc(h.config.Health.LivenessPath, h.livenessHandler).Methods(http.MethodGet, http.MethodHead)
+	r.HandleFunc(h.config.Health.ReadinessPath, h.readinessHandler).Methods(http.MethodGet, http.MethodHead)
+}
+
+// SetDraining Readiness will fail from now on (server is shutting down)
+func (h *Health) SetDraining() {
+	atomic.StoreInt32(&h.draining, 1)
+}
+
+// IsDraining Returns if the server is shutting down
+func (h *Health) IsDraining() bool {
+	return atomic.LoadInt32(&h.draining) != 0
+}
+
+// GetReadiness Checks if the server can accept traffic
+func (h *Health) GetReadiness() ReadinessStatus {
+	status := ReadinessStatus{
+		Draining:        h.IsDraining(),
+		StorageWritable: true,
+		RAMBytes:        getRAMUsage(),
+		RAMBudgetBytes:  h.config.Storage.MaxRAMBytes,
+	}
+
+	if !h.config.Storage.OnlyRAM {
+		err := checkWritable(h.config.Storage.BasePath)
+		if err != nil {
+			status.StorageWritable = false
+			status.StorageError = err.Error()
+		}
+	}
+
+	hasRAMHeadroom := true
+	if status.RAMBudgetBytes > 0 {
+		hasRAMHeadroom = status.RAMBytes*100 < status.RAMBudgetBytes*int64(h.config.Health.MaxRAMUsagePercent)
+	}
+
+	status.Ready = !status.Draining && status.StorageWritable && hasRAMHeadroom
+
+	return status
+}
+
+func (h *Health) livenessHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]bool{"alive": true})
+}
+
+func (h *Health) readinessHandler(w http.ResponseWriter, r *http.Request) {
+	status := h.GetReadiness()
+
+	code := http.StatusOK
+	if !status.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, status)
+}
+
+// getRAMUsage Returns the bytes of all the files kept in RAM
+func getRAMUsage() int64 {
+	FilesLock.RLock()
+	defer FilesLock.RUnlock()
+
+	ret := int64(0)
+	for _, f := range Files {
+		ret += f.GetRAMBytes()
+	}
+
+	return ret
+}
+
+func checkWritable(basePath string) error {
+	err := os.MkdirAll(basePath, 0755)
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := ioutil.TempFile(basePath, ".readyz-")
+	if err != nil {
+		return err
+	}
+	tmpFile.Close()
+
+	return os.Remove(tmpFile.Name())
+}
@@ -0,0 +1,684 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// HLS segment pattern variables
+const (
+	hlsStreamVar = "<stream>"
+	hlsNumberVar = "<n>"
+)
+
+// When the segments are added to the playlist
+const (
+	HLSAddOnStart    = "start"
+	HLSAddOnComplete = "complete"
+)
+
+// HLS playlist defaults
+const (
+	hlsDefaultPlaylistName    = "chunklist.m3u8"
+	hlsDefaultTargetDurationS = 6
+	hlsDefaultDurationHeader  = "Segment-Duration"
+	hlsDefaultEndHeader       = "Stream-End"
+	hlsPlaylistContentType    = "application/vnd.apple.mpegurl"
+	// hlsPartSegments Last segments listed with their parts
+	hlsPartSegments = 3
+	// hlsPartMinRatio Parts are cut once they reach this ratio of the part target (min allowed for non final parts)
+	hlsPartMinRatio = 0.85
+)
+
+// HLS Maintains live media playlists from the lifecycle events of the segments that match the configured patterns
+type HLS struct {
+	config          *Config
+	waitingRequests *WaitingRequests
+	streams         []*hlsStream
+	playlists       map[string]*hlsPlaylist
+	subscription    *EventSubscription
+	done            chan bool
+	stop            chan struct{}
+	lock            sync.Mutex
+}
+
+// HLSPlaylistInfo State of a playlist
+type HLSPlaylistInfo struct {
+	Key             string `json:"key"`
+	MediaSequence   int64  `json:"mediaSequence"`
+	Segments        int    `json:"segments"`
+	TargetDurationS int    `json:"targetDurationS"`
+	LowLatency      bool   `json:"lowLatency"`
+	Ended           bool   `json:"ended"`
+}
+
+type hlsStream struct {
+	config HLSStreamConfig
+	re     *regexp.Regexp
+	// Position of the submatches, -1 if not in the pattern
+	streamIndex int
+	numberIndex int
+}
+
+// hlsSegmentKey Segment identified from its key
+type hlsSegmentKey struct {
+	stream      *hlsStream
+	playlistKey string
+	streamName  string
+	seq         int64
+	// Digits of the number if it is zero padded, 0 if not
+	width int
+}
+
+type hlsPlaylist struct {
+	key        string
+	stream     *hlsStream
+	streamName string
+	segments   []*hlsSegment
+	ended      bool
+}
+
+type hlsSegment struct {
+	seq       int64
+	uri       string
+	width     int
+	durationS float64
+	complete  bool
+	parts     []hlsPart
+}
+
+// hlsPart Byte range of a segment
+type hlsPart struct {
+	offset      int64
+	size        int64
+	durationS   float64
+	independent bool
+}
+
+// NewHLS Creates a new HLS object, the defaults are applied to the streams
+func NewHLS(config *Config, waitingRequests *WaitingRequests) *HLS {
+	h := HLS{
+		config:          config,
+		waitingRequests: waitingRequests,
+		streams:         []*hlsStream{},
+		playlists:       map[string]*hlsPlaylist{},
+	}
+	for _, streamConfig := range config.HLS.Streams {
+		h.streams = append(h.streams, newHLSStream(streamConfig))
+	}
+
+	return &h
+}
+
+func newHLSStream(config HLSStreamConfig) *hlsStream {
+	if config.PlaylistName == "" {
+		config.PlaylistName = hlsDefaultPlaylistName
+	}
+	if config.TargetDurationS <= 0 {
+		config.TargetDurationS = hlsDefaultTargetDurationS
+	}
+	if config.AddOn == "" {
+		config.AddOn = HLSAddOnComplete
+	}
+	if config.PartTargetDurationS > 0 {
+		// The parts of the segments are listed while they are uploaded
+		config.AddOn = HLSAddOnStart
+	}
+	if config.DurationHeader == "" {
+		config.DurationHeader = hlsDefaultDurationHeader
+	}
+	if config.EndHeader == "" {
+		config.EndHeader = hlsDefaultEndHeader
+	}
+
+	s := hlsStream{
+		config:      config,
+		streamIndex: -1,
+		numberIndex: -1,
+	}
+
+	// Ex: /live/<stream>/seg_<n>.ts -> ^/live/(.+)/seg_(\d+)\.ts$
+	expr := regexp.QuoteMeta(config.SegmentPattern)
+	index := 1
+	for {
+		streamPos := strings.Index(expr, hlsStreamVar)
+		numberPos := strings.Index(expr, hlsNumberVar)
+		if numberPos >= 0 && (streamPos < 0 || numberPos < streamPos) {
+			expr = strings.Replace(expr, hlsNumberVar, `(\d+)`, 1)
+			s.numberIndex = index
+		} else if streamPos >= 0 {
+			expr = strings.Replace(expr, hlsStreamVar, `(.+)`, 1)
+			s.streamIndex = index
+		} else {
+			break
+		}
+		index++
+	}
+	s.re = regexp.MustCompile("^" + expr + "$")
+
+	return &s
+}
+
+// isLowLatency Returns true if the segments are split in parts
+func (s *hlsStream) isLowLatency() bool {
+	return s.config.PartTargetDurationS > 0
+}
+
+// getSegmentURI Returns the URI (relative to the playlist) of a segment of the stream
+func (s *hlsStream) getSegmentURI(streamName string, seq int64, width int) string {
+	key := strings.ReplaceAll(s.config.SegmentPattern, hlsStreamVar, streamName)
+	key = strings.Replace(key, hlsNumberVar, fmt.Sprintf("%0*d", width, seq), 1)
+	return path.Base(key)
+}
+
+// Start Starts following the lifecycle events
+func (h *HLS) Start() {
+	// Lossless, a dropped event would leave the playlist wrong for good
+	h.subscription = objectEvents.SubscribeLossless("/")
+	h.done = make(chan bool)
+	h.stop = make(chan struct{})
+
+	go func() {
+		defer close(h.done)
+		for e := range h.subscription.C {
+			h.onEvent(e)
+		}
+	}()
+}
+
+// Stop Stops following the lifecycle events
+func (h *HLS) Stop() {
+	objectEvents.Unsubscribe(h.subscription)
+	close(h.stop)
+	<-h.done
+}
+
+// GetPlaylists Returns the state of every playlist
+func (h *HLS) GetPlaylists() []HLSPlaylistInfo {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	ret := []HLSPlaylistInfo{}
+	for _, pl := range h.playlists {
+		ret = append(ret, pl.getInfo())
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Key < ret[j].Key
+	})
+
+	return ret
+}
+
+// End Declares the stream of the playlist finished (#EXT-X-ENDLIST), returns false if the playlist does not exist
+func (h *HLS) End(key string) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	pl, ok := h.playlists[key]
+	if !ok {
+		return false
+	}
+	if !pl.ended {
+		pl.ended = true
+		h.writePlaylist(pl)
+	}
+	return true
+}
+
+// match Returns the stream, playlist and sequence number of a segment key
+func (h *HLS) match(key string) (hlsSegmentKey, bool) {
+	for _, s := range h.streams {
+		m := s.re.FindStringSubmatch(key)
+		if m == nil {
+			continue
+		}
+		number := m[s.numberIndex]
+		seq, err := strconv.ParseInt(number, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		sk := hlsSegmentKey{
+			stream: s,
+			seq:    seq,
+		}
+		if len(number) > 1 && number[0] == '0' {
+			sk.width = len(number)
+		}
+		playlistName := s.config.PlaylistName
+		if s.streamIndex > 0 {
+			sk.streamName = m[s.streamIndex]
+			playlistName = strings.ReplaceAll(playlistName, hlsStreamVar, path.Base(sk.streamName))
+		}
+		sk.playlistKey = path.Join(path.Dir(key), playlistName)
+		return sk, true
+	}
+
+	return hlsSegmentKey{}, false
+}
+
+func (h *HLS) onEvent(e ObjectEvent) {
+	sk, ok := h.match(e.Key)
+	if !ok {
+		return
+	}
+
+	switch e.Type {
+	case EventCreated:
+		if sk.stream.config.AddOn != HLSAddOnStart {
+			return
+		}
+		h.addSegment(sk, e, false)
+	case EventFirstByte:
+		if sk.stream.config.AddOn != HLSAddOnStart {
+			return
+		}
+		h.startSegment(sk, e.Key)
+	case EventCompleted:
+		h.addSegment(sk, e, true)
+	case EventFailed, EventDeleted, EventExpired:
+		h.removeSegment(sk)
+	}
+}
+
+func (h *HLS) addSegment(sk hlsSegmentKey, e ObjectEvent, complete bool) {
+	durationS := getHLSDurationHeader(e.Headers, sk.stream.config.DurationHeader)
+	if durationS <= 0 && complete {
+		// Out of the lock, it reads the whole segment
+		durationS = h.getMediaDuration(sk, e.Key)
+	}
+	if target := sk.stream.config.TargetDurationS; int(math.Round(durationS)) > target {
+		// The target duration of a live playlist can not change
+		logWarnf("HLS %s segment %d duration %.3fs is longer than the target duration %ds", sk.playlistKey, sk.seq, durationS, target)
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	pl, ok := h.playlists[sk.playlistKey]
+	if !ok {
+		pl = &hlsPlaylist{
+			key:        sk.playlistKey,
+			stream:     sk.stream,
+			streamName: sk.streamName,
+			segments:   []*hlsSegment{},
+		}
+		h.playlists[sk.playlistKey] = pl
+	}
+
+	if pl.ended {
+		// New segments after the end reopen the stream
+		pl.ended = false
+	}
+	if !pl.setSegment(sk, path.Base(e.Key), durationS, complete) {
+		logDebugf("HLS %s segment %d is out of the window", sk.playlistKey, sk.seq)
+		return
+	}
+	if e.Headers.Get(sk.stream.config.EndHeader) != "" {
+		pl.ended = true
+	}
+
+	h.writePlaylist(pl)
+}
+
+// startSegment The upload of a segment listed on start has data: the readers waiting for it (Ex: preload hints)
+// can read it chunked, and its parts are followed
+func (h *HLS) startSegment(sk hlsSegmentKey, key string) {
+	if h.waitingRequests != nil {
+		h.waitingRequests.ReceivedDataFor(key)
+	}
+	if !sk.stream.isLowLatency() {
+		return
+	}
+
+	FilesLock.RLock()
+	f, ok := Files[key]
+	FilesLock.RUnlock()
+	if !ok {
+		return
+	}
+	go h.followParts(sk, f)
+}
+
+// followParts Groups the ingest chunks of an in-progress segment in parts of about the part target duration. The
+// durations come from the media timestamps if the segment is indexed, else from the arrival time of the chunks
+func (h *HLS) followParts(sk hlsSegmentKey, f *File) {
+	minDurationS := sk.stream.config.PartTargetDurationS * hlsPartMinRatio
+	timescales := h.getInitTimescales(sk, f.Name)
+	partStartAt, _ := f.getIngestTimes()
+	partStart := int64(0)
+	lastChunk := fileChunk{}
+
+	for from := 0; ; {
+		chunks, eof := f.waitChunks(from, h.stop)
+		from += len(chunks)
+		for _, c := range chunks {
+			lastChunk = c
+			// At the end of the chunk, or of the last complete media unit if the segment is indexed
+			end, ok := f.getPartEnd(partStart, c.Offset+c.Size)
+			if !ok {
+				continue
+			}
+			durationS, ok := f.getMediaDurationS(partStart, end, timescales)
+			if !ok {
+				durationS = c.At.Sub(partStartAt).Seconds()
+			}
+			if durationS < minDurationS {
+				continue
+			}
+			h.addPart(sk, hlsPart{offset: partStart, size: end - partStart, durationS: durationS, independent: f.isRandomAccess(partStart)})
+			partStart = end
+			partStartAt = c.At
+		}
+		if eof {
+			break
+		}
+	}
+
+	select {
+	case <-h.stop:
+		return
+	default:
+	}
+	if f.IsFailed() {
+		return
+	}
+	// Final part, it can be shorter
+	end := lastChunk.Offset + lastChunk.Size
+	if end > partStart {
+		durationS, ok := f.getMediaDurationS(partStart, end, timescales)
+		if !ok {
+			durationS = lastChunk.At.Sub(partStartAt).Seconds()
+		}
+		h.addPart(sk, hlsPart{offset: partStart, size: end - partStart, durationS: durationS, independent: f.isRandomAccess(partStart)})
+	}
+}
+
+func (h *HLS) addPart(sk hlsSegmentKey, part hlsPart) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	pl, ok := h.playlists[sk.playlistKey]
+	if !ok {
+		return
+	}
+	seg := pl.getSegment(sk.seq)
+	if seg == nil {
+		// Out of the window, or removed
+		return
+	}
+	seg.parts = append(seg.parts, part)
+
+	h.writePlaylist(pl)
+}
+
+func (h *HLS) removeSegment(sk hlsSegmentKey) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	pl, ok := h.playlists[sk.playlistKey]
+	if !ok {
+		return
+	}
+	for i, seg := range pl.segments {
+		if seg.seq == sk.seq {
+			pl.segments = append(pl.segments[:i], pl.segments[i+1:]...)
+			h.writePlaylist(pl)
+			return
+		}
+	}
+}
+
+// getMediaDuration Returns the duration computed from the segment data: the PTS of MPEG-TS, or the sample
+// durations of fMP4 (it needs the timescale of the InitSegment). 0 if it is unknown
+func (h *HLS) getMediaDuration(sk hlsSegmentKey, key string) float64 {
+	ext := getKeyExtension(key)
+	switch {
+	case ext == ".ts":
+		data, ok := h.readObject(key)
+		if !ok {
+			return 0
+		}
+		return getTSDuration(data)
+	case isFMP4Extension(ext):
+		timescales := h.getInitTimescales(sk, key)
+		if timescales == nil {
+			return 0
+		}
+		data, ok := h.readObject(key)
+		if !ok {
+			return 0
+		}
+		return getFMP4Duration(data, timescales)
+	}
+	return 0
+}
+
+// getInitTimescales Returns the timescales (by track ID) of the InitSegment of a fMP4 segment, nil if they are unknown
+func (h *HLS) getInitTimescales(sk hlsSegmentKey, key string) map[uint32]uint32 {
+	if !isFMP4Extension(getKeyExtension(key)) || sk.stream.config.InitSegment == "" {
+		return nil
+	}
+	init, ok := h.readObject(path.Join(path.Dir(key), sk.stream.config.InitSegment))
+	if !ok {
+		return nil
+	}
+	timescales, _ := getFMP4Timescales(init)
+	return timescales
+}
+
+// readObject Returns the data of a complete object
+func (h *HLS) readObject(key string) ([]byte, bool) {
+	FilesLock.RLock()
+	f, ok := Files[key]
+	FilesLock.RUnlock()
+	if !ok {
+		return nil, false
+	}
+
+	rc, err := f.OpenReadCloser(h.config.Storage.BasePath, nil)
+	if err != nil {
+		return nil, false
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+// writePlaylist Replaces the playlist object with the current state, h.lock must be held
+func (h *HLS) writePlaylist(pl *hlsPlaylist) {
+	writeManifest(h.waitingRequests, pl.key, hlsPlaylistContentType, []byte(pl.render()))
+	logDebugf("HLS %s updated, %d segments", pl.key, len(pl.segments))
+}
+
+// getSegment Returns the segment with the sequence number, nil if it is not in the playlist
+func (pl *hlsPlaylist) getSegment(seq int64) *hlsSegment {
+	i := sort.Search(len(pl.segments), func(i int) bool {
+		return pl.segments[i].seq >= seq
+	})
+	if i < len(pl.segments) && pl.segments[i].seq == seq {
+		return pl.segments[i]
+	}
+	return nil
+}
+
+// setSegment Adds or updates a segment keeping them sorted and inside the window (of sequence numbers, the
+// missing ones are gaps), returns false if it is too old
+func (pl *hlsPlaylist) setSegment(sk hlsSegmentKey, uri string, durationS float64, complete bool) bool {
+	if seg := pl.getSegment(sk.seq); seg != nil {
+		if durationS > 0 {
+			seg.durationS = durationS
+		}
+		seg.complete = seg.complete || complete
+	} else {
+		windowSize := int64(pl.stream.config.WindowSize)
+		newest := sk.seq
+		if len(pl.segments) > 0 && pl.segments[len(pl.segments)-1].seq > newest {
+			newest = pl.segments[len(pl.segments)-1].seq
+		}
+		if windowSize > 0 && sk.seq <= newest-windowSize {
+			return false
+		}
+
+		i := sort.Search(len(pl.segments), func(i int) bool {
+			return pl.segments[i].seq >= sk.seq
+		})
+		seg := &hlsSegment{
+			seq:       sk.seq,
+			uri:       uri,
+			width:     sk.width,
+			durationS: durationS,
+			complete:  complete,
+			parts:     []hlsPart{},
+		}
+		pl.segments = append(pl.segments, nil)
+		copy(pl.segments[i+1:], pl.segments[i:])
+		pl.segments[i] = seg
+
+		if windowSize > 0 {
+			first := sort.Search(len(pl.segments), func(i int) bool {
+				return pl.segments[i].seq > newest-windowSize
+			})
+			pl.segments = pl.segments[first:]
+		}
+	}
+	return true
+}
+
+// hasGaps Returns true if there are missing sequence numbers between the segments
+func (pl *hlsPlaylist) hasGaps() bool {
+	for i := 1; i < len(pl.segments); i++ {
+		if pl.segments[i].seq != pl.segments[i-1].seq+1 {
+			return true
+		}
+	}
+	return false
+}
+
+func (pl *hlsPlaylist) render() string {
+	config := pl.stream.config
+	lowLatency := pl.stream.isLowLatency()
+	version := 3
+	if config.InitSegment != "" || lowLatency {
+		// EXT-X-MAP in a playlist without EXT-X-I-FRAMES-ONLY, and the LL-HLS byte range parts
+		version = 6
+	}
+	if pl.hasGaps() {
+		// EXT-X-GAP
+		version = 8
+	}
+	mediaSequence := int64(0)
+	if len(pl.segments) > 0 {
+		mediaSequence = pl.segments[0].seq
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	fmt.Fprintf(&b, "#EXT-X-VERSION:%d\n", version)
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", config.TargetDurationS)
+	if lowLatency {
+		fmt.Fprintf(&b, "#EXT-X-SERVER-CONTROL:PART-HOLD-BACK=%.3f\n", 3*config.PartTargetDurationS)
+		fmt.Fprintf(&b, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", config.PartTargetDurationS)
+	}
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", mediaSequence)
+	if config.InitSegment != "" {
+		fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"%s\"\n", config.InitSegment)
+	}
+	for i, seg := range pl.segments {
+		if i > 0 {
+			// Missing segments (not uploaded yet, or removed) keep their place, so every media sequence number is
+			// always the same URI
+			prev := pl.segments[i-1]
+			for seq := prev.seq + 1; seq < seg.seq; seq++ {
+				b.WriteString("#EXT-X-GAP\n")
+				fmt.Fprintf(&b, "#EXTINF:%.3f,\n", float64(config.TargetDurationS))
+				b.WriteString(pl.stream.getSegmentURI(pl.streamName, seq, prev.width) + "\n")
+			}
+		}
+		last := i == len(pl.segments)-1
+		if lowLatency && i >= len(pl.segments)-hlsPartSegments {
+			for _, part := range seg.parts {
+				independent := ""
+				if part.independent {
+					independent = ",INDEPENDENT=YES"
+				}
+				fmt.Fprintf(&b, "#EXT-X-PART:DURATION=%.3f,URI=\"%s\",BYTERANGE=\"%d@%d\"%s\n", part.durationS, seg.uri, part.size, part.offset, independent)
+			}
+		}
+		if lowLatency && last && !seg.complete {
+			// Only its parts until it is complete
+			break
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n", seg.getDurationS(config.TargetDurationS))
+		b.WriteString(seg.uri + "\n")
+	}
+	if lowLatency && !pl.ended && len(pl.segments) > 0 {
+		// Next part: the rest of the in-progress segment, or the start of the next one
+		last := pl.segments[len(pl.segments)-1]
+		uri := last.uri
+		start := int64(0)
+		if last.complete {
+			uri = pl.stream.getSegmentURI(pl.streamName, last.seq+1, last.width)
+		} else if len(last.parts) > 0 {
+			lastPart := last.parts[len(last.parts)-1]
+			start = lastPart.offset + lastPart.size
+		}
+		fmt.Fprintf(&b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"%s\",BYTERANGE-START=%d\n", uri, start)
+	}
+	if pl.ended {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+
+	return b.String()
+}
+
+func (pl *hlsPlaylist) getInfo() HLSPlaylistInfo {
+	info := HLSPlaylistInfo{
+		Key:             pl.key,
+		Segments:        len(pl.segments),
+		TargetDurationS: pl.stream.config.TargetDurationS,
+		LowLatency:      pl.stream.isLowLatency(),
+		Ended:           pl.ended,
+	}
+	if len(pl.segments) > 0 {
+		info.MediaSequence = pl.segments[0].seq
+	}
+	return info
+}
+
+// getDurationS Returns the known duration, or the one of its parts, or the target duration
+func (seg *hlsSegment) getDurationS(targetDurationS int) float64 {
+	if seg.durationS > 0 {
+		return seg.durationS
+	}
+
+	partsDurationS := 0.0
+	for _, part := range seg.parts {
+		partsDurationS += part.durationS
+	}
+	if seg.complete && partsDurationS > 0 {
+		return partsDurationS
+	}
+	// Still unknown (added when the upload started)
+	return float64(targetDurationS)
+}
+
+// getHLSDurationHeader Returns the segment duration (seconds) in the header, 0 if it is not valid
+func getHLSDurationHeader(headers http.Header, name string) float64 {
+	durationS, err := strconv.ParseFloat(headers.Get(name), 64)
+	if err != nil || durationS <= 0 || math.IsInf(durationS, 0) {
+		return 0
+	}
+	return durationS
+}
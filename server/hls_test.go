@@ -0,0 +1,147 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// newTestPlaylist Returns an empty playlist of the stream "a", and a function to add (or update) its segments by
+// key, it returns nil if the segment is out of the window
+func newTestPlaylist(t *testing.T, streamConfig HLSStreamConfig) (*hlsPlaylist, func(key string, durationS float64, complete bool) *hlsSegment) {
+	config := NewConfig()
+	config.HLS.Streams = []HLSStreamConfig{streamConfig}
+	h := NewHLS(config, nil)
+	pl := &hlsPlaylist{stream: h.streams[0], streamName: "a", segments: []*hlsSegment{}}
+
+	add := func(key string, durationS float64, complete bool) *hlsSegment {
+		sk, ok := h.match(key)
+		if !ok {
+			t.Fatalf("%s does not match", key)
+		}
+		if !pl.setSegment(sk, sk.stream.getSegmentURI(sk.streamName, sk.seq, sk.width), durationS, complete) {
+			return nil
+		}
+		return pl.getSegment(sk.seq)
+	}
+	return pl, add
+}
+
+func TestHLSMatch(t *testing.T) {
+	config := NewConfig()
+	config.HLS.Streams = []HLSStreamConfig{{SegmentPattern: "/live/<stream>/seg_<n>.ts"}}
+	h := NewHLS(config, nil)
+
+	sk, ok := h.match("/live/cam1/seg_007.ts")
+	if !ok || sk.streamName != "cam1" || sk.seq != 7 || sk.width != 3 || sk.playlistKey != "/live/cam1/"+hlsDefaultPlaylistName {
+		t.Errorf("match = %+v %v", sk, ok)
+	}
+	if got := sk.stream.getSegmentURI(sk.streamName, 8, sk.width); got != "seg_008.ts" {
+		t.Errorf("getSegmentURI = %q, want seg_008.ts", got)
+	}
+	for _, key := range []string{"/live/cam1/seg_x.ts", "/live/cam1/seg_1.m4s", "/vod/cam1/seg_1.ts"} {
+		if _, ok := h.match(key); ok {
+			t.Errorf("%s matches", key)
+		}
+	}
+}
+
+func TestHLSRenderGaps(t *testing.T) {
+	pl, add := newTestPlaylist(t, HLSStreamConfig{SegmentPattern: "/live/<stream>/seg_<n>.ts", WindowSize: 4, TargetDurationS: 2})
+	add("/live/a/seg_1.ts", 2, true)
+	add("/live/a/seg_2.ts", 1.5, true)
+	add("/live/a/seg_4.ts", 0, true)
+
+	want := `#EXTM3U
+#EXT-X-VERSION:8
+#EXT-X-TARGETDURATION:2
+#EXT-X-MEDIA-SEQUENCE:1
+#EXTINF:2.000,
+seg_1.ts
+#EXTINF:1.500,
+seg_2.ts
+#EXT-X-GAP
+#EXTINF:2.000,
+seg_3.ts
+#EXTINF:2.000,
+seg_4.ts
+`
+	if got := pl.render(); got != want {
+		t.Errorf("render =\n%s\nwant\n%s", got, want)
+	}
+
+	// The window is of sequence numbers, the oldest ones are removed and the late ones ignored
+	add("/live/a/seg_6.ts", 2, true)
+	if seg := add("/live/a/seg_4.ts", 1.8, true); seg == nil || seg.durationS != 1.8 {
+		t.Errorf("updating a segment in the window failed")
+	}
+	if seg := add("/live/a/seg_2.ts", 2, true); seg != nil {
+		t.Errorf("segment out of the window added")
+	}
+	add("/live/a/seg_7.ts", 2, true)
+	got := pl.render()
+	if !strings.Contains(got, "#EXT-X-MEDIA-SEQUENCE:4\n") || strings.Contains(got, "seg_3.ts") {
+		t.Errorf("render after the window moved =\n%s", got)
+	}
+	if !strings.Contains(got, "#EXT-X-GAP\n#EXTINF:2.000,\nseg_5.ts\n") {
+		t.Errorf("render without the gap of seg_5.ts =\n%s", got)
+	}
+
+	pl.segments = pl.segments[:0]
+	add("/live/a/seg_8.ts", 2, true)
+	pl.ended = true
+	if got := pl.render(); !strings.Contains(got, "#EXT-X-VERSION:3\n") || !strings.HasSuffix(got, "#EXT-X-ENDLIST\n") {
+		t.Errorf("render of an ended playlist without gaps =\n%s", got)
+	}
+}
+
+func TestHLSRenderLowLatency(t *testing.T) {
+	pl, add := newTestPlaylist(t, HLSStreamConfig{
+		SegmentPattern:      "/ll/<stream>/seg_<n>.m4s",
+		TargetDurationS:     2,
+		PartTargetDurationS: 0.5,
+		InitSegment:         "init.mp4",
+	})
+	seg := add("/ll/a/seg_1.m4s", 0, true)
+	seg.parts = []hlsPart{
+		{offset: 0, size: 100, durationS: 1, independent: true},
+		{offset: 100, size: 50, durationS: 0.96},
+	}
+	seg = add("/ll/a/seg_2.m4s", 0, false)
+	seg.parts = []hlsPart{{offset: 0, size: 80, durationS: 0.48, independent: true}}
+
+	want := `#EXTM3U
+#EXT-X-VERSION:6
+#EXT-X-TARGETDURATION:2
+#EXT-X-SERVER-CONTROL:PART-HOLD-BACK=1.500
+#EXT-X-PART-INF:PART-TARGET=0.500
+#EXT-X-MEDIA-SEQUENCE:1
+#EXT-X-MAP:URI="init.mp4"
+#EXT-X-PART:DURATION=1.000,URI="seg_1.m4s",BYTERANGE="100@0",INDEPENDENT=YES
+#EXT-X-PART:DURATION=0.960,URI="seg_1.m4s",BYTERANGE="50@100"
+#EXTINF:1.960,
+seg_1.m4s
+#EXT-X-PART:DURATION=0.480,URI="seg_2.m4s",BYTERANGE="80@0",INDEPENDENT=YES
+#EXT-X-PRELOAD-HINT:TYPE=PART,URI="seg_2.m4s",BYTERANGE-START=80
+`
+	if got := pl.render(); got != want {
+		t.Errorf("render =\n%s\nwant\n%s", got, want)
+	}
+
+	// Complete, the hint is the start of the next segment
+	add("/ll/a/seg_2.m4s", 0.48, true)
+	got := pl.render()
+	if !strings.Contains(got, "#EXTINF:0.480,\nseg_2.m4s\n") || !strings.HasSuffix(got, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"seg_3.m4s\",BYTERANGE-START=0\n") {
+		t.Errorf("render after the segment completes =\n%s", got)
+	}
+}
+
+func TestHLSDurationHeader(t *testing.T) {
+	headers := http.Header{}
+	for value, want := range map[string]float64{"1.5": 1.5, "": 0, "abc": 0, "-1": 0, "0": 0, "Inf": 0} {
+		headers.Set(hlsDefaultDurationHeader, value)
+		if got := getHLSDurationHeader(headers, hlsDefaultDurationHeader); got != want {
+			t.Errorf("getHLSDurationHeader(%q) = %f, want %f", value, got, want)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// Hooks In-process extension points for the embedders, register them with RegisterHooks before StartHTTPServer.
+// The hooks are called from the request goroutines, so they must be safe for concurrent use.
+// Embed NopHooks to implement only some of them
+type Hooks interface {
+	// OnUploadStart Called before creating the object of a POST / PUT, ctx.Headers are the headers to store.
+	// Returning an error rejects the upload (with the status of a HookError, 403 otherwise)
+	OnUploadStart(ctx *HookContext) error
+
+	// OnChunk Called for every chunk received, returns the bytes to store (p, a transformed copy, or empty to skip them).
+	// Returning an error aborts the upload
+	OnChunk(ctx *HookContext, p []byte) ([]byte, error)
+
+	// OnUploadComplete Called when the object is complete
+	OnUploadComplete(ctx *HookContext)
+
+	// OnRead Called before sending an object, ctx.Headers are the headers to reply. Returning an error rejects the request
+	OnRead(ctx *HookContext) error
+
+	// OnDelete Called before deleting an object. Returning an error keeps it
+	OnDelete(ctx *HookContext) error
+}
+
+// HookContext Object and request a hook is called for. Metadata is attached to the object: it is set
+// by the upload hooks, and it is available to the read / delete hooks and in the admin object info
+type HookContext struct {
+	Key      string
+	Request  *http.Request
+	Headers  http.Header
+	Metadata map[string]string
+}
+
+// HookError Error returned by a hook to reject a request with Status
+type HookError struct {
+	Status  int
+	Message string
+}
+
+// Error Returns the error message
+func (e *HookError) Error() string {
+	return e.Message
+}
+
+// NopHooks Hooks that do nothing
+type NopHooks struct{}
+
+// OnUploadStart Accepts the upload
+func (NopHooks) OnUploadStart(ctx *HookContext) error { return nil }
+
+// OnChunk Stores the chunk as it is
+func (NopHooks) OnChunk(ctx *HookContext, p []byte) ([]byte, error) { return p, nil }
+
+// OnUploadComplete Does nothing
+func (NopHooks) OnUploadComplete(ctx *HookContext) {}
+
+// OnRead Accepts the read
+func (NopHooks) OnRead(ctx *HookContext) error { return nil }
+
+// OnDelete Accepts the delete
+func (NopHooks) OnDelete(ctx *HookContext) error { return nil }
+
+// hookChain Registered hooks, called in registration order (the first error wins)
+type hookChain []Hooks
+
+var (
+	registeredHooks     = hookChain{}
+	registeredHooksLock = new(sync.RWMutex)
+)
+
+// RegisterHooks Adds hooks to the server
+func RegisterHooks(hooks ...Hooks) {
+	registeredHooksLock.Lock()
+	defer registeredHooksLock.Unlock()
+
+	registeredHooks = append(registeredHooks, hooks...)
+}
+
+// getHooks Returns the registered hooks
+func getHooks() hookChain {
+	registeredHooksLock.RLock()
+	defer registeredHooksLock.RUnlock()
+
+	return registeredHooks
+}
+
+func newHookContext(key string, r *http.Request, headers http.Header, metadata map[string]string) *HookContext {
+	ctx := HookContext{
+		Key:      key,
+		Request:  r,
+		Headers:  headers,
+		Metadata: map[string]string{},
+	}
+	for k, v := range metadata {
+		ctx.Metadata[k] = v
+	}
+
+	return &ctx
+}
+
+func (hc hookChain) OnUploadStart(ctx *HookContext) error {
+	for _, h := range hc {
+		if err := h.OnUploadStart(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (hc hookChain) OnChunk(ctx *HookContext, p []byte) ([]byte, error) {
+	var err error
+	for _, h := range hc {
+		p, err = h.OnChunk(ctx, p)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func (hc hookChain) OnUploadComplete(ctx *HookContext) {
+	for _, h := range hc {
+		h.OnUploadComplete(ctx)
+	}
+}
+
+func (hc hookChain) OnRead(ctx *HookContext) error {
+	for _, h := range hc {
+		if err := h.OnRead(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (hc hookChain) OnDelete(ctx *HookContext) error {
+	for _, h := range hc {
+		if err := h.OnDelete(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chunkHookWriter Passes every chunk through the OnChunk hooks before writing it to dst
+type chunkHookWriter struct {
+	hooks hookChain
+	ctx   *HookContext
+	dst   io.Writer
+}
+
+// Write Writes the (transformed) chunk, returns len(p) so the copy goes on even if the size changed
+func (w *chunkHookWriter) Write(p []byte) (int, error) {
+	out, err := w.hooks.OnChunk(w.ctx, p)
+	if err != nil {
+		return 0, &hookAbortError{err}
+	}
+	if len(out) > 0 {
+		_, err = w.dst.Write(out)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// newChunkHookWriter Returns dst if there are no hooks
+func newChunkHookWriter(hooks hookChain, ctx *HookContext, dst io.Writer) io.Writer {
+	if len(hooks) <= 0 {
+		return dst
+	}
+	return &chunkHookWriter{hooks: hooks, ctx: ctx, dst: dst}
+}
+
+// hookAbortError Upload aborted by a hook, it is never kept as complete
+type hookAbortError struct {
+	err error
+}
+
+func (e *hookAbortError) Error() string {
+	return "aborted by hook: " + e.err.Error()
+}
+
+func (e *hookAbortError) Unwrap() error {
+	return e.err
+}
+
+// getHookErrorStatus Returns the status of a request rejected by a hook
+func getHookErrorStatus(err error) int {
+	var hookErr *HookError
+	if errors.As(err, &hookErr) && hookErr.Status > 0 {
+		return hookErr.Status
+	}
+	return http.StatusForbidden
+}
+
+// getHookAbortStatus Returns the status of an upload aborted by a hook, 0 if it was not aborted by a hook
+func getHookAbortStatus(err error) int {
+	var abortErr *hookAbortError
+	if !errors.As(err, &abortErr) {
+		return 0
+	}
+	return getHookErrorStatus(err)
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// newHTTP3Server Creates the HTTP/3 (QUIC) server, it serves the same handler than the TLS listener
+func newHTTP3Server(config *Config, handler http.Handler) *http3.Server {
+	return &http3.Server{
+		Addr:    config.Listen.Address + ":" + strconv.Itoa(getHTTP3Port(config)),
+		Handler: handler,
+		QUICConfig: &quic.Config{
+			MaxIncomingStreams: config.HTTP3.MaxIncomingStreams,
+			MaxIdleTimeout:     time.Duration(config.HTTP3.IdleTimeoutMs) * time.Millisecond,
+		},
+	}
+}
+
+// altSvcHandler Advertises the HTTP/3 listener in the HTTP/1.1 and HTTP/2 responses
+func altSvcHandler(config *Config, next http.Handler) http.Handler {
+	altSvc := fmt.Sprintf(`h3=":%d"; ma=%d`, getHTTP3Port(config), config.HTTP3.AltSvcMaxAgeS)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor < 3 {
+			w.Header().Set("Alt-Svc", altSvc)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// getHTTP3Port UDP port of the HTTP/3 listener, by default the same than the TLS listener
+func getHTTP3Port(config *Config) int {
+	if config.HTTP3.Port > 0 {
+		return config.HTTP3.Port
+	}
+	return config.Listen.Port
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"errors"
+	"strings"
+)
+
+// mediaIndexes Indexes built while the objects are ingested, replaced by StartHTTPServer with the configured ones
+var mediaIndexes = NewConfig().Index
+
+// errInvalidMedia Wrapped by the errors of the objects that can not be indexed
+var errInvalidMedia = errors.New("invalid media")
+
+// mediaIndex Index of the media units (Ex: fMP4 fragments) of an object, it is built from the bytes written, in
+// order, while the File lock is held
+type mediaIndex interface {
+	// write Parses the bytes written at offset
+	write(offset int64, p []byte)
+	// getBoundary Returns the end of the last complete unit in (start, end], false if there is none
+	getBoundary(start int64, end int64) (int64, bool)
+	// isRandomAccess Returns true if the unit that starts at offset can be decoded on its own (Ex: keyframe)
+	isRandomAccess(offset int64) bool
+	// getMediaTime Returns the duration of the units that start in [start, end) in timescale units. timescales
+	// are the ones of the init segment by track ID (Ex: fMP4 segments, the moov is in the init segment), the
+	// returned timescale is 0 if it is not known
+	getMediaTime(start int64, end int64, timescales map[uint32]uint32) (uint64, uint32, bool)
+	// getJoin Returns the bytes to send before the last random access unit (the PAT / PMT) and its offset, false
+	// if there is no random access unit yet. Only MPEG-TS supports joins, the fMP4 index always returns false
+	getJoin() ([]byte, int64, bool)
+	// getError Returns the error (wrapping errInvalidMedia) if the bytes written can not be indexed
+	getError() error
+	// getInfo Returns a snapshot of the index for the admin API
+	getInfo() interface{}
+}
+
+// isFMP4Extension Returns true for the extensions of the fragmented MP4 objects
+func isFMP4Extension(ext string) bool {
+	return ext == ".m4s" || ext == ".mp4" || strings.HasPrefix(ext, ".cmf")
+}
+
+// checkMediaIndex Returns the index error of an ingested file if the uploads that can not be indexed fail
+func checkMediaIndex(f *File) error {
+	if mediaIndexes.OnError != IngestPolicyFail {
+		return nil
+	}
+	return f.getIndexError()
+}
+
+// newMediaIndex Returns the index for the object key, nil if it is not indexed
+func newMediaIndex(key string) mediaIndex {
+	ext := getKeyExtension(key)
+	if mediaIndexes.FMP4 && isFMP4Extension(ext) {
+		return newFMP4Index()
+	}
+	if mediaIndexes.TS && ext == ".ts" {
+		return newTSIndex(key)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Policies for uploads that time out or are interrupted
+const (
+	IngestPolicyComplete = "complete"
+	IngestPolicyFail     = "fail"
+)
+
+var (
+	errIngestIdle     = errors.New("ingest idle timeout")
+	errIngestDuration = errors.New("ingest max duration")
+)
+
+type connContextKey struct{}
+
+// saveConnInContext Used as http.Server.ConnContext, so stalled uploads can be aborted
+func saveConnInContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, c)
+}
+
+// abortRequestBody Unblocks the reads of the request body
+func abortRequestBody(r *http.Request) {
+	if r.ProtoMajor == 1 {
+		if conn, ok := r.Context().Value(connContextKey{}).(net.Conn); ok {
+			conn.SetReadDeadline(time.Now())
+			return
+		}
+	}
+	// HTTP/2 streams are aborted closing the body
+	r.Body.Close()
+}
+
+// ingestWatchdog Aborts an upload that does not receive data for idle, or it is not complete after maxDuration
+type ingestWatchdog struct {
+	f           *File
+	idle        time.Duration
+	maxDuration time.Duration
+	abort       func(err error)
+
+	timer   *time.Timer
+	err     error
+	stopped bool
+	lock    sync.Mutex
+}
+
+// watchIngest Starts the watchdog of a file being ingested (0 disables each timeout), abort is called at most once
+func watchIngest(f *File, idle time.Duration, maxDuration time.Duration, abort func(err error)) *ingestWatchdog {
+	wd := ingestWatchdog{
+		f:           f,
+		idle:        idle,
+		maxDuration: maxDuration,
+		abort:       abort,
+	}
+
+	if idle > 0 || maxDuration > 0 {
+		wd.lock.Lock()
+		wd.timer = time.AfterFunc(wd.nextCheck(time.Now()), wd.check)
+		wd.lock.Unlock()
+	}
+
+	return &wd
+}
+
+// Stop Stops the watchdog, returns the error if the upload was aborted
+func (wd *ingestWatchdog) Stop() error {
+	wd.lock.Lock()
+	defer wd.lock.Unlock()
+
+	wd.stopped = true
+	if wd.timer != nil {
+		wd.timer.Stop()
+	}
+
+	return wd.err
+}
+
+func (wd *ingestWatchdog) check() {
+	wd.lock.Lock()
+	defer wd.lock.Unlock()
+
+	if wd.stopped {
+		return
+	}
+
+	now := time.Now()
+	receivedAt, lastWriteAt := wd.f.getIngestTimes()
+	if wd.maxDuration > 0 && now.Sub(receivedAt) >= wd.maxDuration {
+		wd.err = errIngestDuration
+	} else if wd.idle > 0 && now.Sub(lastWriteAt) >= wd.idle {
+		wd.err = errIngestIdle
+	}
+
+	if wd.err != nil {
+		wd.stopped = true
+		wd.abort(wd.err)
+		return
+	}
+	wd.timer.Reset(wd.nextCheck(now))
+}
+
+// nextCheck Returns the time until the closest deadline
+func (wd *ingestWatchdog) nextCheck(now time.Time) time.Duration {
+	receivedAt, lastWriteAt := wd.f.getIngestTimes()
+
+	next := time.Duration(-1)
+	if wd.maxDuration > 0 {
+		next = receivedAt.Add(wd.maxDuration).Sub(now)
+	}
+	if wd.idle > 0 {
+		idleNext := lastWriteAt.Add(wd.idle).Sub(now)
+		if next < 0 || idleNext < next {
+			next = idleNext
+		}
+	}
+	if next < time.Millisecond {
+		next = time.Millisecond
+	}
+
+	return next
+}
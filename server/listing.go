@@ -0,0 +1,241 @@
+package server
+
+import (
+	"html/template"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ListEntry Child of a directory listing, a file or a directory (aggregating all its descendants)
+type ListEntry struct {
+	Name       string     `json:"name"`
+	Key        string     `json:"key"`
+	Type       string     `json:"type"`
+	Size       int64      `json:"size"`
+	Objects    int        `json:"objects,omitempty"`
+	Complete   bool       `json:"complete"`
+	Storage    string     `json:"storage,omitempty"`
+	ReceivedAt *time.Time `json:"receivedAt,omitempty"`
+}
+
+// DirListing Response of a listing
+type DirListing struct {
+	Prefix  string      `json:"prefix"`
+	Entries []ListEntry `json:"entries"`
+}
+
+var listingTemplate = template.Must(template.New("listing").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Index of {{.Prefix}}</title></head>
+<body>
+<h1>Index of {{.Prefix}}</h1>
+<table>
+<tr><th>Name</th><th>Size</th><th>State</th><th>Storage</th></tr>
+{{range .Entries}}<tr><td><a href="{{.Key}}">{{.Name}}</a></td><td>{{.Size}}</td><td>{{if eq .Type "dir"}}{{.Objects}} objects{{else if .Complete}}complete{{else}}in progress{{end}}</td><td>{{.Storage}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// IsListRequest Returns true for GET requests of a directory (path ending with /) or with the list query param
+func IsListRequest(r *http.Request) bool {
+	if _, ok := r.URL.Query()["list"]; ok {
+		return true
+	}
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		return false
+	}
+
+	// A file could be stored with that name
+	FilesLock.RLock()
+	_, exists := Files[r.URL.String()]
+	FilesLock.RUnlock()
+
+	return !exists
+}
+
+// Query params of the prefix DELETE, the root prefix (all the objects) also needs confirm=all
+const (
+	recursiveParam    = "recursive"
+	confirmParam      = "confirm"
+	confirmAllObjects = "all"
+)
+
+// IsPrefixDeleteRequest Returns true for DELETE requests with the recursive query param (the explicit opt-in, a
+// path ending with / is just an object key)
+func IsPrefixDeleteRequest(r *http.Request) bool {
+	_, ok := r.URL.Query()[recursiveParam]
+	return ok
+}
+
+// ListHandler Sends the children of a directory as JSON (or HTML if the client accepts it)
+func ListHandler(cors *Cors, w http.ResponseWriter, r *http.Request) {
+	prefix := getDirPrefix(r.URL.Path)
+	_, recursive := r.URL.Query()[recursiveParam]
+
+	listing := DirListing{
+		Prefix:  prefix,
+		Entries: getListEntries(prefix, recursive),
+	}
+
+	addCors(w, cors)
+	if strings.Contains(r.Header.Get("Accept"), "text/html") || r.URL.Query().Get("list") == "html" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		listingTemplate.Execute(w, listing)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, listing)
+}
+
+// DeletePrefixHandler Deletes all the files under a directory, from RAM and disk (removing the empty dirs)
+func DeletePrefixHandler(onlyRAM bool, cors *Cors, basePath string, w http.ResponseWriter, r *http.Request) {
+	prefix := getDirPrefix(r.URL.Path)
+	if prefix == "/" && r.URL.Query().Get(confirmParam) != confirmAllObjects {
+		// It would wipe the whole store
+		addCors(w, cors)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	FilesLock.RLock()
+	candidates := []*File{}
+	for key, f := range Files {
+		if strings.HasPrefix(key, prefix) {
+			candidates = append(candidates, f)
+		}
+	}
+	FilesLock.RUnlock()
+
+	// The hooks can keep some of them
+	hooks := getHooks()
+	accepted := candidates[:0]
+	for _, f := range candidates {
+		if hooks.OnDelete(newHookContext(f.Name, r, f.GetHeaders(), f.GetMetadata())) == nil {
+			accepted = append(accepted, f)
+		}
+	}
+
+	FilesLock.Lock()
+	filesToDel := []*File{}
+	for _, f := range accepted {
+		if Files[f.Name] == f {
+			filesToDel = append(filesToDel, f)
+			delete(Files, f.Name)
+		}
+	}
+	FilesLock.Unlock()
+	for _, f := range filesToDel {
+		unscheduleExpiry(f)
+	}
+
+	addCors(w, cors)
+	if len(filesToDel) <= 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if !onlyRAM {
+		for _, f := range filesToDel {
+			err := f.RemoveFromDisk(basePath)
+			if err != nil && !os.IsNotExist(err) {
+				logWarnf("Error removing %s from disk: %v", f.Name, err)
+			}
+		}
+		removeEmptyDirs(basePath, prefix)
+	}
+	for _, f := range filesToDel {
+		publishEvent(EventDeleted, f)
+	}
+	logDebugf("DELETE prefix %s, deleted %d objects", prefix, len(filesToDel))
+
+	writeJSON(w, http.StatusOK, map[string]int{"deleted": len(filesToDel)})
+}
+
+func getListEntries(prefix string, recursive bool) []ListEntry {
+	FilesLock.RLock()
+	files := []*File{}
+	for key, f := range Files {
+		if strings.HasPrefix(key, prefix) {
+			files = append(files, f)
+		}
+	}
+	FilesLock.RUnlock()
+
+	entries := []ListEntry{}
+	dirs := map[string]*ListEntry{}
+	for _, f := range files {
+		info := f.GetInfo()
+		rest := info.Key[len(prefix):]
+
+		if idx := strings.Index(rest, "/"); idx >= 0 && !recursive {
+			dirName := rest[:idx+1]
+			dir, exists := dirs[dirName]
+			if !exists {
+				dir = &ListEntry{
+					Name:     dirName,
+					Key:      prefix + dirName,
+					Type:     "dir",
+					Complete: true,
+				}
+				dirs[dirName] = dir
+			}
+			dir.Objects++
+			dir.Size += info.Size
+			dir.Complete = dir.Complete && info.Complete
+			continue
+		}
+
+		receivedAt := info.ReceivedAt
+		entries = append(entries, ListEntry{
+			Name:       rest,
+			Key:        info.Key,
+			Type:       "file",
+			Size:       info.Size,
+			Complete:   info.Complete,
+			Storage:    info.Storage,
+			ReceivedAt: &receivedAt,
+		})
+	}
+	for _, dir := range dirs {
+		entries = append(entries, *dir)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+
+	return entries
+}
+
+func getDirPrefix(urlPath string) string {
+	if strings.HasSuffix(urlPath, "/") {
+		return urlPath
+	}
+	return urlPath + "/"
+}
+
+// removeEmptyDirs Removes all the empty dirs under prefix (included)
+func removeEmptyDirs(basePath string, prefix string) {
+	root := path.Join(basePath, prefix)
+
+	dirs := []string{}
+	filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			dirs = append(dirs, p)
+		}
+		return nil
+	})
+
+	// Deepest first, os.Remove fails for the NOT empty ones
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if filepath.Clean(dirs[i]) == filepath.Clean(basePath) {
+			continue
+		}
+		os.Remove(dirs[i])
+	}
+}
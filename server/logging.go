@@ -0,0 +1,323 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log levels
+const (
+	LevelDebug = 0
+	LevelInfo  = 1
+	LevelWarn  = 2
+	LevelError = 3
+)
+
+var (
+	levelNames = []string{"debug", "info", "warn", "error"}
+
+	logLevel = LevelInfo
+)
+
+type accessLogContextKey struct{}
+
+// AccessLogEntry Data logged for every request
+type AccessLogEntry struct {
+	Time       string  `json:"time"`
+	Level      string  `json:"level"`
+	Method     string  `json:"method"`
+	Key        string  `json:"key"`
+	Proto      string  `json:"proto"`
+	Status     int     `json:"status"`
+	BytesIn    int64   `json:"bytesIn"`
+	BytesOut   int64   `json:"bytesOut"`
+	DurationMs float64 `json:"durationMs"`
+	WaitedMs   float64 `json:"waitedMs"`
+	Source     string  `json:"source,omitempty"`
+	RemoteAddr string  `json:"remoteAddr"`
+}
+
+// AccessLogger Writes one JSON line per request
+type AccessLogger struct {
+	out   io.Writer
+	level int
+	lock  sync.Mutex
+}
+
+// RotatingFile Log file that is rotated when it reaches a max size
+type RotatingFile struct {
+	path       string
+	maxBytes   int64
+	maxBackups int
+
+	file *os.File
+	size int64
+	lock sync.Mutex
+}
+
+// ParseLevel Returns the level for a name (debug, info, warn, error)
+func ParseLevel(name string) (int, error) {
+	for i, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return i, nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", name)
+}
+
+// SetLogLevel Sets the min level of the server log
+func SetLogLevel(level int) {
+	logLevel = level
+}
+
+func logDebugf(format string, v ...interface{}) {
+	if logLevel <= LevelDebug {
+		log.Printf(format, v...)
+	}
+}
+
+func logWarnf(format string, v ...interface{}) {
+	if logLevel <= LevelWarn {
+		log.Printf(format, v...)
+	}
+}
+
+// NewLogOutput Returns stdout, stderr or a rotating file for the path
+func NewLogOutput(path string, maxSizeMB int, maxBackups int) (io.Writer, error) {
+	switch path {
+	case "", "stdout":
+		return os.Stdout, nil
+	case "stderr":
+		return os.Stderr, nil
+	}
+	return NewRotatingFile(path, int64(maxSizeMB)*1024*1024, maxBackups)
+}
+
+// NewRotatingFile Opens (appending) a log file, if maxBytes <= 0 it is never rotated
+func NewRotatingFile(path string, maxBytes int64, maxBackups int) (*RotatingFile, error) {
+	rf := RotatingFile{
+		path:       path,
+		maxBytes:   maxBytes,
+		maxBackups: maxBackups,
+	}
+
+	err := rf.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return &rf, nil
+}
+
+// Write Writes to the file, rotating it first if needed
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+
+	if rf.maxBytes > 0 && rf.size+int64(len(p)) > rf.maxBytes && rf.size > 0 {
+		err := rf.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// Close Closes the file
+func (rf *RotatingFile) Close() error {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+
+	return rf.file.Close()
+}
+
+func (rf *RotatingFile) open() error {
+	if _, err := os.Stat(filepath.Dir(rf.path)); os.IsNotExist(err) {
+		err := os.MkdirAll(filepath.Dir(rf.path), 0755)
+		if err != nil {
+			return err
+		}
+	}
+
+	file, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	rf.file = file
+	rf.size = info.Size()
+	return nil
+}
+
+// rotate Renames file -> file.1 -> file.2 ... dropping the ones above maxBackups
+func (rf *RotatingFile) rotate() error {
+	rf.file.Close()
+
+	if rf.maxBackups <= 0 {
+		os.Remove(rf.path)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", rf.path, rf.maxBackups))
+		for i := rf.maxBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+		}
+		os.Rename(rf.path, rf.path+".1")
+	}
+
+	return rf.open()
+}
+
+// NewAccessLogger Creates an access logger that writes entries at or above level
+func NewAccessLogger(out io.Writer, level int) *AccessLogger {
+	return &AccessLogger{
+		out:   out,
+		level: level,
+	}
+}
+
+// Log Writes an entry as a JSON line
+func (al *AccessLogger) Log(entry *AccessLogEntry) {
+	level := LevelInfo
+	if entry.Status >= 500 {
+		level = LevelError
+	} else if entry.Status >= 400 {
+		level = LevelWarn
+	}
+	if level < al.level {
+		return
+	}
+	entry.Level = levelNames[level]
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	al.lock.Lock()
+	defer al.lock.Unlock()
+	al.out.Write(append(b, '\n'))
+}
+
+// Handler Wraps a handler logging every request once it finishes
+func (al *AccessLogger) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		entry := &AccessLogEntry{
+			Method:     r.Method,
+			Key:        getLogKey(r.URL),
+			Proto:      r.Proto,
+			RemoteAddr: r.RemoteAddr,
+		}
+
+		body := &countingReadCloser{ReadCloser: r.Body}
+		r.Body = body
+		rec := &statusRecorder{ResponseWriter: w}
+		r = r.WithContext(context.WithValue(r.Context(), accessLogContextKey{}, entry))
+
+		defer func() {
+			entry.Time = start.UTC().Format(time.RFC3339Nano)
+			entry.Status = rec.status
+			if entry.Status == 0 {
+				entry.Status = http.StatusOK
+			}
+			entry.BytesIn += body.n
+			entry.BytesOut += rec.n
+			entry.DurationMs = float64(time.Since(start)) / float64(time.Millisecond)
+			al.Log(entry)
+		}()
+
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// getLogKey Returns the key of the request without the tokens that can be in the query
+func getLogKey(u *url.URL) string {
+	return getKeyWithout(u, accessTokenParam)
+}
+
+// getAccessLogEntry Returns the entry of the request (to be filled by handlers) or a throwaway one
+func getAccessLogEntry(r *http.Request) *AccessLogEntry {
+	entry, ok := r.Context().Value(accessLogContextKey{}).(*AccessLogEntry)
+	if !ok {
+		return &AccessLogEntry{}
+	}
+	return entry
+}
+
+type countingReadCloser struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	n      int64
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(p)
+	s.n += int64(n)
+	return n, err
+}
+
+// Flush Needed to keep chunked egress working
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack Needed by the WebSocket upgrades
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijack not supported")
+	}
+	conn, rw, err := hj.Hijack()
+	if err == nil {
+		s.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// Unwrap Lets http.ResponseController reach the underlying writer (write deadlines)
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
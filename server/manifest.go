@@ -0,0 +1,24 @@
+package server
+
+import (
+	"net/http"
+)
+
+// writeManifest Replaces the object key with a complete one generated by the server (playlists, MPDs),
+// and wakes up the requests waiting for it. It is an internal file, the rewrites do NOT publish lifecycle events
+func writeManifest(waitingRequests *WaitingRequests, key string, contentType string, body []byte) {
+	headers := http.Header{}
+	headers.Set("Content-Type", contentType)
+
+	f := newInternalFile(key, headers, -1)
+	f.Write(body)
+	f.Close()
+
+	FilesLock.Lock()
+	Files[key] = f
+	FilesLock.Unlock()
+
+	if waitingRequests != nil {
+		waitingRequests.ReceivedDataFor(key)
+	}
+}
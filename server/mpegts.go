@@ -0,0 +1,463 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// MPEG-TS constants
+const (
+	tsPacketSize = 188
+	tsSyncByte   = 0x47
+	tsClockHz    = 90000
+)
+
+// tsPacket Fields of a TS packet header used by the server
+type tsPacket struct {
+	pid          uint16
+	payloadStart bool
+	randomAccess bool
+	payload      []byte
+}
+
+// parseTSPacket Parses a 188 bytes packet, returns false if it is not a valid one
+func parseTSPacket(p []byte) (tsPacket, bool) {
+	pkt := tsPacket{}
+	if len(p) < tsPacketSize || p[0] != tsSyncByte {
+		return pkt, false
+	}
+
+	pkt.payloadStart = p[1]&0x40 != 0
+	pkt.pid = uint16(p[1]&0x1F)<<8 | uint16(p[2])
+	adaptationControl := (p[3] >> 4) & 0x3
+
+	offset := 4
+	if adaptationControl&0x2 != 0 {
+		adaptationLength := int(p[4])
+		if adaptationLength > 0 {
+			pkt.randomAccess = p[5]&0x40 != 0
+		}
+		offset = 5 + adaptationLength
+	}
+	if adaptationControl&0x1 != 0 && offset < tsPacketSize {
+		pkt.payload = p[offset:tsPacketSize]
+	}
+
+	return pkt, true
+}
+
+// getPESPTS Returns the PTS of a PES that starts in payload
+func getPESPTS(payload []byte) (int64, bool) {
+	if len(payload) < 14 || payload[0] != 0 || payload[1] != 0 || payload[2] != 1 {
+		return 0, false
+	}
+	// PTS_DTS_flags
+	if payload[7]&0x80 == 0 {
+		return 0, false
+	}
+
+	b := payload[9:14]
+	pts := int64(b[0]>>1&0x07)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 | int64(b[3])<<7 | int64(b[4]>>1)
+	return pts, true
+}
+
+// getPESDecodeTime Returns the DTS of a PES that starts in payload, or its PTS if it has no DTS
+func getPESDecodeTime(payload []byte) (int64, bool) {
+	if len(payload) >= 19 && payload[7]&0xC0 == 0xC0 {
+		b := payload[14:19]
+		return int64(b[0]>>1&0x07)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 | int64(b[3])<<7 | int64(b[4]>>1), true
+	}
+	return getPESPTS(payload)
+}
+
+// getTSDuration Returns the duration (in seconds) of a TS segment from the PTS of its stream with more PES, 0 if unknown
+func getTSDuration(data []byte) float64 {
+	type ptsRange struct {
+		first int64
+		last  int64
+		count int64
+	}
+	ranges := map[uint16]*ptsRange{}
+
+	for offset := 0; offset+tsPacketSize <= len(data); offset += tsPacketSize {
+		pkt, ok := parseTSPacket(data[offset : offset+tsPacketSize])
+		if !ok || !pkt.payloadStart {
+			continue
+		}
+		pts, ok := getPESPTS(pkt.payload)
+		if !ok {
+			continue
+		}
+		r, exists := ranges[pkt.pid]
+		if !exists {
+			ranges[pkt.pid] = &ptsRange{first: pts, last: pts, count: 1}
+			continue
+		}
+		if pts < r.first {
+			r.first = pts
+		}
+		if pts > r.last {
+			r.last = pts
+		}
+		r.count++
+	}
+
+	var best *ptsRange
+	for _, r := range ranges {
+		if best == nil || r.count > best.count {
+			best = r
+		}
+	}
+	if best == nil || best.count < 2 {
+		return 0
+	}
+
+	// Add the average frame duration, the last frame lasts too
+	ticks := float64(best.last-best.first) * float64(best.count) / float64(best.count-1)
+	return ticks / tsClockHz
+}
+
+// MPEG-TS PIDs and stream types
+const (
+	tsPATPID        = 0x0000
+	tsStreamMPEG1   = 0x01
+	tsStreamMPEG2   = 0x02
+	tsStreamH264    = 0x1B
+	tsStreamH265    = 0x24
+	tsNoPID         = 0xFFFF
+	tsPESHeaderSize = 9
+)
+
+// errPSISplit PAT / PMT sections split in several packets are not supported (no keyframe joins then)
+var errPSISplit = errors.New("PSI section split in several packets not supported")
+
+// TSIndexInfo Snapshot of the index of a MPEG-TS object. RandomAccess are the offsets of the video packets that
+// start a keyframe, LostSyncAt the offset where the 188 bytes alignment was lost first (-1 if never), PSIError
+// why the last PAT / PMT could not be used
+type TSIndexInfo struct {
+	Type         string  `json:"type"`
+	Packets      int64   `json:"packets"`
+	LostSync     int64   `json:"lostSync"`
+	LostSyncAt   int64   `json:"lostSyncAt"`
+	PMTPID       int     `json:"pmtPID"`
+	VideoPID     int     `json:"videoPID"`
+	StreamType   int     `json:"streamType"`
+	RandomAccess []int64 `json:"randomAccess"`
+	PSIError     string  `json:"psiError,omitempty"`
+	Error        string  `json:"error,omitempty"`
+}
+
+// tsRun Contiguous aligned packets in [start, end)
+type tsRun struct {
+	start int64
+	end   int64
+}
+
+// tsFrame Start of a video PES
+type tsFrame struct {
+	offset     int64
+	decodeTime int64
+}
+
+// tsIndex Incremental parser of the packets, it keeps the last PAT / PMT, the keyframe offsets and the decode
+// times of the video PES
+type tsIndex struct {
+	key string
+
+	// Bytes of the packet split between writes
+	pending       []byte
+	pendingOffset int64
+	runs          []tsRun
+
+	packets    int64
+	lostSync   int64
+	lostSyncAt int64
+
+	pat          []byte
+	pmt          []byte
+	pmtPID       uint16
+	videoPID     uint16
+	streamType   byte
+	randomAccess []int64
+	frames       []tsFrame
+	psiErr       error
+}
+
+func newTSIndex(key string) *tsIndex {
+	return &tsIndex{
+		key:          key,
+		pending:      []byte{},
+		lostSyncAt:   -1,
+		pmtPID:       tsNoPID,
+		videoPID:     tsNoPID,
+		randomAccess: []int64{},
+		frames:       []tsFrame{},
+	}
+}
+
+func (idx *tsIndex) write(offset int64, p []byte) {
+	if len(idx.pending) == 0 {
+		idx.pendingOffset = offset
+	}
+	idx.pending = append(idx.pending, p...)
+
+	pos := 0
+	for len(idx.pending)-pos >= tsPacketSize {
+		if idx.pending[pos] != tsSyncByte {
+			// Not aligned, resync on the next sync byte
+			if idx.lostSyncAt < 0 {
+				idx.lostSyncAt = idx.pendingOffset + int64(pos)
+				logWarnf("INGEST %s MPEG-TS packets not aligned at %d", idx.key, idx.lostSyncAt)
+			}
+			idx.lostSync++
+			next := bytes.IndexByte(idx.pending[pos+1:], tsSyncByte)
+			if next < 0 {
+				pos = len(idx.pending)
+				break
+			}
+			pos += 1 + next
+			continue
+		}
+
+		offset := idx.pendingOffset + int64(pos)
+		idx.parsePacket(offset, idx.pending[pos:pos+tsPacketSize])
+		pos += tsPacketSize
+		if last := len(idx.runs) - 1; last >= 0 && idx.runs[last].end == offset {
+			idx.runs[last].end += tsPacketSize
+		} else {
+			idx.runs = append(idx.runs, tsRun{start: offset, end: offset + tsPacketSize})
+		}
+	}
+
+	// Keeps only the incomplete packet
+	idx.pendingOffset += int64(pos)
+	idx.pending = append(idx.pending[:0], idx.pending[pos:]...)
+}
+
+func (idx *tsIndex) parsePacket(offset int64, p []byte) {
+	idx.packets++
+	pkt, ok := parseTSPacket(p)
+	if !ok {
+		return
+	}
+
+	switch {
+	case pkt.pid == tsPATPID && pkt.payloadStart:
+		idx.pat = append(idx.pat[:0], p...)
+		pmtPID, err := parsePAT(pkt.payload)
+		idx.setPSIError(err)
+		if err == nil {
+			idx.pmtPID = pmtPID
+		}
+	case pkt.pid == idx.pmtPID && pkt.payloadStart:
+		idx.pmt = append(idx.pmt[:0], p...)
+		videoPID, streamType, err := parsePMT(pkt.payload)
+		idx.setPSIError(err)
+		if err == nil {
+			idx.videoPID = videoPID
+			idx.streamType = streamType
+		}
+	case pkt.pid == idx.videoPID && pkt.payloadStart:
+		if pkt.randomAccess || isKeyframePES(idx.streamType, pkt.payload) {
+			idx.randomAccess = append(idx.randomAccess, offset)
+		}
+		if decodeTime, ok := getPESDecodeTime(pkt.payload); ok {
+			idx.frames = append(idx.frames, tsFrame{offset: offset, decodeTime: decodeTime})
+		}
+	}
+}
+
+// setPSIError Keeps the result of the last PAT / PMT parsing, logging the changes
+func (idx *tsIndex) setPSIError(err error) {
+	if err != nil && (idx.psiErr == nil || err.Error() != idx.psiErr.Error()) {
+		logWarnf("INGEST %s MPEG-TS %v", idx.key, err)
+	}
+	idx.psiErr = err
+}
+
+// getBoundary Returns the end of the last packet that ends at or before end
+func (idx *tsIndex) getBoundary(start int64, end int64) (int64, bool) {
+	for i := len(idx.runs) - 1; i >= 0; i-- {
+		run := idx.runs[i]
+		boundary := run.end
+		if end < boundary {
+			boundary = run.start + (end-run.start)/tsPacketSize*tsPacketSize
+		}
+		if boundary > run.start {
+			return boundary, boundary > start
+		}
+	}
+	return 0, false
+}
+
+func (idx *tsIndex) isRandomAccess(offset int64) bool {
+	i := sort.Search(len(idx.randomAccess), func(i int) bool { return idx.randomAccess[i] >= offset })
+	return i < len(idx.randomAccess) && idx.randomAccess[i] == offset
+}
+
+// getMediaTime Returns the time from the decode time of the first video PES in [start, end) to the one of the
+// next PES, the last one lasts as the previous one (the timescale is always the 90kHz clock)
+func (idx *tsIndex) getMediaTime(start int64, end int64, timescales map[uint32]uint32) (uint64, uint32, bool) {
+	first := sort.Search(len(idx.frames), func(i int) bool { return idx.frames[i].offset >= start })
+	next := sort.Search(len(idx.frames), func(i int) bool { return idx.frames[i].offset >= end })
+	if next <= first {
+		return 0, 0, false
+	}
+
+	var endTime int64
+	switch {
+	case next < len(idx.frames):
+		endTime = idx.frames[next].decodeTime
+	case next >= 2:
+		endTime = 2*idx.frames[next-1].decodeTime - idx.frames[next-2].decodeTime
+	default:
+		return 0, 0, false
+	}
+	startTime := idx.frames[first].decodeTime
+	if endTime <= startTime {
+		return 0, 0, false
+	}
+	return uint64(endTime - startTime), tsClockHz, true
+}
+
+// getJoin Returns the PAT and PMT packets, and the offset of the last keyframe
+func (idx *tsIndex) getJoin() ([]byte, int64, bool) {
+	if len(idx.pat) == 0 || len(idx.pmt) == 0 || len(idx.randomAccess) == 0 {
+		return nil, 0, false
+	}
+
+	prefix := make([]byte, 0, 2*tsPacketSize)
+	prefix = append(prefix, idx.pat...)
+	prefix = append(prefix, idx.pmt...)
+	return prefix, idx.randomAccess[len(idx.randomAccess)-1], true
+}
+
+func (idx *tsIndex) getError() error {
+	if idx.lostSyncAt >= 0 {
+		return fmt.Errorf("%w: MPEG-TS packets not aligned at %d", errInvalidMedia, idx.lostSyncAt)
+	}
+	return nil
+}
+
+func (idx *tsIndex) getInfo() interface{} {
+	info := TSIndexInfo{
+		Type:         "ts",
+		Packets:      idx.packets,
+		LostSync:     idx.lostSync,
+		LostSyncAt:   idx.lostSyncAt,
+		PMTPID:       -1,
+		VideoPID:     -1,
+		StreamType:   int(idx.streamType),
+		RandomAccess: append([]int64{}, idx.randomAccess...),
+	}
+	if idx.pmtPID != tsNoPID {
+		info.PMTPID = int(idx.pmtPID)
+	}
+	if idx.videoPID != tsNoPID {
+		info.VideoPID = int(idx.videoPID)
+	}
+	if idx.psiErr != nil {
+		info.PSIError = idx.psiErr.Error()
+	}
+	if err := idx.getError(); err != nil {
+		info.Error = err.Error()
+	}
+	return info
+}
+
+// getPSISection Returns the section (after the pointer field) of a PSI payload, without the CRC
+func getPSISection(payload []byte) ([]byte, error) {
+	if len(payload) < 1 {
+		return nil, errors.New("empty PSI payload")
+	}
+	start := 1 + int(payload[0])
+	if len(payload) < start+3 {
+		if start <= len(payload) {
+			return nil, errPSISplit
+		}
+		return nil, errors.New("invalid PSI pointer field")
+	}
+	section := payload[start:]
+	sectionLength := int(section[1]&0x0F)<<8 | int(section[2])
+	end := 3 + sectionLength - 4
+	if sectionLength < 9 {
+		return nil, fmt.Errorf("invalid PSI section length %d", sectionLength)
+	}
+	if len(section) < end {
+		return nil, errPSISplit
+	}
+	return section[:end], nil
+}
+
+// parsePAT Returns the PMT PID of the first program
+func parsePAT(payload []byte) (uint16, error) {
+	section, err := getPSISection(payload)
+	if err != nil {
+		return 0, fmt.Errorf("PAT: %w", err)
+	}
+	if section[0] != 0x00 {
+		return 0, fmt.Errorf("PAT: invalid table ID %d", section[0])
+	}
+
+	for i := 8; i+4 <= len(section); i += 4 {
+		programNumber := uint16(section[i])<<8 | uint16(section[i+1])
+		if programNumber == 0 {
+			// Network PID
+			continue
+		}
+		return uint16(section[i+2]&0x1F)<<8 | uint16(section[i+3]), nil
+	}
+	return 0, errors.New("PAT: no program")
+}
+
+// parsePMT Returns the PID and stream type of the first video stream
+func parsePMT(payload []byte) (uint16, byte, error) {
+	section, err := getPSISection(payload)
+	if err != nil {
+		return 0, 0, fmt.Errorf("PMT: %w", err)
+	}
+	if section[0] != 0x02 || len(section) < 12 {
+		return 0, 0, fmt.Errorf("PMT: invalid table ID %d", section[0])
+	}
+
+	programInfoLength := int(section[10]&0x0F)<<8 | int(section[11])
+	for i := 12 + programInfoLength; i+5 <= len(section); {
+		streamType := section[i]
+		pid := uint16(section[i+1]&0x1F)<<8 | uint16(section[i+2])
+		esInfoLength := int(section[i+3]&0x0F)<<8 | int(section[i+4])
+		switch streamType {
+		case tsStreamMPEG1, tsStreamMPEG2, tsStreamH264, tsStreamH265:
+			return pid, streamType, nil
+		}
+		i += 5 + esInfoLength
+	}
+	return 0, 0, errors.New("PMT: no video stream")
+}
+
+// isKeyframePES Returns true if the start of a video PES has an IDR / IRAP NAL unit (H.264 and H.265)
+func isKeyframePES(streamType byte, payload []byte) bool {
+	if len(payload) < tsPESHeaderSize || payload[0] != 0 || payload[1] != 0 || payload[2] != 1 {
+		return false
+	}
+	es := payload[tsPESHeaderSize+int(payload[8]):]
+
+	for i := 0; i+3 < len(es); i++ {
+		if es[i] != 0 || es[i+1] != 0 || es[i+2] != 1 {
+			continue
+		}
+		header := es[i+3]
+		switch streamType {
+		case tsStreamH264:
+			if header&0x1F == 5 {
+				return true
+			}
+		case tsStreamH265:
+			if nalType := (header >> 1) & 0x3F; nalType >= 16 && nalType <= 21 {
+				return true
+			}
+		}
+	}
+	return false
+}
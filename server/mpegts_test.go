@@ -0,0 +1,219 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+)
+
+const (
+	testPMTPID   = 0x1000
+	testVideoPID = 0x100
+)
+
+// tsTestPacket Returns a packet with the payload, stuffed with 0xFF
+func tsTestPacket(pid uint16, payloadStart bool, payload []byte) []byte {
+	p := bytes.Repeat([]byte{0xFF}, tsPacketSize)
+	p[0] = tsSyncByte
+	p[1] = byte(pid>>8) & 0x1F
+	if payloadStart {
+		p[1] |= 0x40
+	}
+	p[2] = byte(pid)
+	// Payload only
+	p[3] = 0x10
+	copy(p[4:], payload)
+	return p
+}
+
+func tsTestPAT() []byte {
+	section := []byte{0x00, 0xB0, 13, 0x00, 0x01, 0xC1, 0x00, 0x00, 0x00, 0x01, 0xE0 | testPMTPID>>8, testPMTPID & 0xFF, 0, 0, 0, 0}
+	return tsTestPacket(tsPATPID, true, append([]byte{0}, section...))
+}
+
+func tsTestPMT() []byte {
+	section := []byte{0x02, 0xB0, 18, 0x00, 0x01, 0xC1, 0x00, 0x00, 0xE1, 0x00, 0xF0, 0x00,
+		tsStreamH264, 0xE0 | testVideoPID>>8, testVideoPID & 0xFF, 0xF0, 0x00, 0, 0, 0, 0}
+	return tsTestPacket(testPMTPID, true, append([]byte{0}, section...))
+}
+
+// tsTimestamp Encodes a PTS / DTS with the 4 bits prefix
+func tsTimestamp(prefix byte, ts int64) []byte {
+	return []byte{
+		prefix<<4 | byte(ts>>29)&0x0E | 1,
+		byte(ts >> 22),
+		byte(ts>>14)&0xFE | 1,
+		byte(ts >> 7),
+		byte(ts<<1)&0xFE | 1,
+	}
+}
+
+// tsTestFrame Returns the first packet of a H.264 PES with the PTS, an IDR if keyframe
+func tsTestFrame(pts int64, keyframe bool) []byte {
+	nal := byte(0x41)
+	if keyframe {
+		nal = 0x65
+	}
+	pes := append([]byte{0, 0, 1, 0xE0, 0, 0, 0x80, 0x80, 5}, tsTimestamp(0x2, pts)...)
+	pes = append(pes, 0, 0, 0, 1, nal)
+	return tsTestPacket(testVideoPID, true, pes)
+}
+
+// tsTestStream Returns PAT, PMT, IDR, P, P, PAT, PMT, IDR, P at 30 fps (3000 ticks per frame)
+func tsTestStream() []byte {
+	packets := [][]byte{
+		tsTestPAT(), tsTestPMT(), tsTestFrame(0, true), tsTestFrame(3000, false), tsTestFrame(6000, false),
+		tsTestPAT(), tsTestPMT(), tsTestFrame(9000, true), tsTestFrame(12000, false),
+	}
+	return bytes.Join(packets, nil)
+}
+
+func TestTSIndex(t *testing.T) {
+	data := tsTestStream()
+	idx := newTSIndex("/test.ts")
+	writeInPieces(idx, data, 100)
+
+	if err := idx.getError(); err != nil {
+		t.Fatalf("getError = %v", err)
+	}
+	info := idx.getInfo().(TSIndexInfo)
+	if info.Packets != 9 || info.PMTPID != testPMTPID || info.VideoPID != testVideoPID || info.StreamType != tsStreamH264 {
+		t.Errorf("info = %+v", info)
+	}
+	wantRandomAccess := []int64{2 * tsPacketSize, 7 * tsPacketSize}
+	if len(info.RandomAccess) != 2 || info.RandomAccess[0] != wantRandomAccess[0] || info.RandomAccess[1] != wantRandomAccess[1] {
+		t.Errorf("randomAccess = %v, want %v", info.RandomAccess, wantRandomAccess)
+	}
+	if !idx.isRandomAccess(2*tsPacketSize) || idx.isRandomAccess(3*tsPacketSize) {
+		t.Errorf("isRandomAccess of the IDR / P frames is wrong")
+	}
+
+	prefix, offset, ok := idx.getJoin()
+	if !ok || offset != 7*tsPacketSize || !bytes.Equal(prefix, data[5*tsPacketSize:7*tsPacketSize]) {
+		t.Errorf("getJoin = %d %v, want the last PAT / PMT and %d", offset, ok, 7*tsPacketSize)
+	}
+
+	// The last packet ending at or before end
+	for _, tt := range []struct {
+		start int64
+		end   int64
+		want  int64
+		ok    bool
+	}{
+		{0, int64(len(data)), int64(len(data)), true},
+		{0, 3*tsPacketSize + 100, 3 * tsPacketSize, true},
+		{3 * tsPacketSize, 3*tsPacketSize + 100, 3 * tsPacketSize, false},
+	} {
+		end, ok := idx.getBoundary(tt.start, tt.end)
+		if ok != tt.ok || (ok && end != tt.want) {
+			t.Errorf("getBoundary(%d, %d) = %d %v, want %d %v", tt.start, tt.end, end, ok, tt.want, tt.ok)
+		}
+	}
+
+	// Until the next frame, the last one lasts as the previous one
+	for _, tt := range []struct {
+		start int64
+		end   int64
+		want  uint64
+	}{
+		{0, 5 * tsPacketSize, 9000},
+		{3 * tsPacketSize, 4 * tsPacketSize, 3000},
+		{7 * tsPacketSize, int64(len(data)), 6000},
+	} {
+		ticks, timescale, ok := idx.getMediaTime(tt.start, tt.end, nil)
+		if !ok || ticks != tt.want || timescale != tsClockHz {
+			t.Errorf("getMediaTime(%d, %d) = %d %d %v, want %d %d", tt.start, tt.end, ticks, timescale, ok, tt.want, tsClockHz)
+		}
+	}
+	if _, _, ok := idx.getMediaTime(0, 2*tsPacketSize, nil); ok {
+		t.Errorf("getMediaTime without frames is ok")
+	}
+}
+
+func TestTSIndexMisaligned(t *testing.T) {
+	data := tsTestStream()
+	garbageAt := 4 * tsPacketSize
+	misaligned := append(append(append([]byte{}, data[:garbageAt]...), 0, 0, 0, 0, 0), data[garbageAt:]...)
+
+	idx := newTSIndex("/test.ts")
+	writeInPieces(idx, misaligned, 188)
+
+	err := idx.getError()
+	if !errors.Is(err, errInvalidMedia) {
+		t.Fatalf("getError = %v, want errInvalidMedia", err)
+	}
+	info := idx.getInfo().(TSIndexInfo)
+	if info.LostSyncAt != int64(garbageAt) || info.Error == "" {
+		t.Errorf("lostSyncAt %d error %q, want %d", info.LostSyncAt, info.Error, garbageAt)
+	}
+	// The keyframe after the garbage is at its real offset
+	if !idx.isRandomAccess(7*tsPacketSize + 5) {
+		t.Errorf("isRandomAccess of the keyframe after the garbage = false")
+	}
+
+	// The boundaries are real packet ends, before and after the garbage
+	resync := int64(garbageAt + 5)
+	for _, tt := range []struct {
+		end  int64
+		want int64
+	}{
+		{resync + 100, int64(garbageAt)},
+		{resync + tsPacketSize, resync + tsPacketSize},
+		{resync + 2*tsPacketSize + 1, resync + 2*tsPacketSize},
+	} {
+		if end, ok := idx.getBoundary(0, tt.end); !ok || end != tt.want {
+			t.Errorf("getBoundary(0, %d) = %d %v, want %d", tt.end, end, ok, tt.want)
+		}
+	}
+}
+
+func TestTSIndexSplitPSI(t *testing.T) {
+	// The pointer field leaves only 1 byte of the PAT section in the packet
+	pat := tsTestPacket(tsPATPID, true, append([]byte{182}, make([]byte, 183)...))
+	data := append(append(pat, tsTestPMT()...), tsTestFrame(0, true)...)
+
+	idx := newTSIndex("/test.ts")
+	idx.write(0, data)
+
+	info := idx.getInfo().(TSIndexInfo)
+	if !strings.Contains(info.PSIError, errPSISplit.Error()) {
+		t.Errorf("psiError = %q, want %q", info.PSIError, errPSISplit)
+	}
+	if len(info.RandomAccess) != 0 {
+		t.Errorf("randomAccess = %v without PMT", info.RandomAccess)
+	}
+	if _, _, ok := idx.getJoin(); ok {
+		t.Errorf("getJoin without PMT is ok")
+	}
+	if err := idx.getError(); err != nil {
+		t.Errorf("getError = %v, the packets are aligned", err)
+	}
+}
+
+func TestPESDecodeTime(t *testing.T) {
+	ptsOnly := append([]byte{0, 0, 1, 0xE0, 0, 0, 0x80, 0x80, 5}, tsTimestamp(0x2, 1<<32+5)...)
+	if got, ok := getPESDecodeTime(ptsOnly); !ok || got != 1<<32+5 {
+		t.Errorf("getPESDecodeTime of PTS only = %d %v, want %d", got, ok, int64(1<<32+5))
+	}
+
+	withDTS := append([]byte{0, 0, 1, 0xE0, 0, 0, 0x80, 0xC0, 10}, tsTimestamp(0x3, 9000)...)
+	withDTS = append(withDTS, tsTimestamp(0x1, 6000)...)
+	if got, ok := getPESDecodeTime(withDTS); !ok || got != 6000 {
+		t.Errorf("getPESDecodeTime with DTS = %d %v, want 6000", got, ok)
+	}
+	if pts, ok := getPESPTS(withDTS); !ok || pts != 9000 {
+		t.Errorf("getPESPTS with DTS = %d %v, want 9000", pts, ok)
+	}
+}
+
+func TestTSDuration(t *testing.T) {
+	// 5 frames of 3000 ticks, the last one lasts too
+	if got := getTSDuration(tsTestStream()); math.Abs(got-15000.0/tsClockHz) > 1e-9 {
+		t.Errorf("getTSDuration = %f, want %f", got, 15000.0/tsClockHz)
+	}
+	if got := getTSDuration(bytes.Join([][]byte{tsTestPAT(), tsTestFrame(0, true)}, nil)); got != 0 {
+		t.Errorf("getTSDuration of 1 frame = %f, want 0", got)
+	}
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// liveRangeLastByte Last byte position of the open ended ranges on in-progress objects (RFC 8673), the response
+// ends when the upload does
+const liveRangeLastByte = 1<<53 - 1
+
+// byteRange Single range of a Range header. End is -1 if it is open ended, and Start is -1 for a suffix
+// range (the last End + 1 bytes)
+type byteRange struct {
+	Start int64
+	End   int64
+}
+
+// parseRange Parses a Range header with one byte range, multiple ranges are not supported
+func parseRange(header string) (byteRange, bool) {
+	br := byteRange{Start: -1, End: -1}
+	if !strings.HasPrefix(header, "bytes=") {
+		return br, false
+	}
+	spec := strings.TrimSpace(strings.TrimPrefix(header, "bytes="))
+	if strings.Contains(spec, ",") {
+		return br, false
+	}
+	startStr, endStr, found := strings.Cut(spec, "-")
+	if !found {
+		return br, false
+	}
+
+	if startStr == "" {
+		// Suffix: bytes=-500
+		n, err := strconv.ParseInt(endStr, 10, 64)
+		if err != nil || n <= 0 {
+			return br, false
+		}
+		br.End = n - 1
+		return br, true
+	}
+
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil || start < 0 {
+		return br, false
+	}
+	br.Start = start
+	if endStr != "" {
+		end, err := strconv.ParseInt(endStr, 10, 64)
+		if err != nil || end < start {
+			return br, false
+		}
+		br.End = end
+	}
+	return br, true
+}
+
+// resolve Returns the range to send for an object with size bytes so far. Ranges on in-progress objects can
+// start or end after size (the reader waits for the data), but suffix ranges need the final size
+func (br byteRange) resolve(size int64, complete bool) (byteRange, bool) {
+	if !complete {
+		return br, br.Start >= 0
+	}
+
+	if br.Start < 0 {
+		br.Start = size - (br.End + 1)
+		if br.Start < 0 {
+			br.Start = 0
+		}
+		br.End = size - 1
+	}
+	if br.Start >= size {
+		return br, false
+	}
+	if br.End < 0 || br.End >= size {
+		br.End = size - 1
+	}
+	return br, true
+}
+
+// setContentRange Sets the Content-Range of a 206 response, total is -1 if it is not known yet
+func (br byteRange) setContentRange(w http.ResponseWriter, total int64) {
+	end := br.End
+	if end < 0 {
+		// Open ended on an in-progress object, the last byte is not known until the upload ends
+		end = liveRangeLastByte
+	}
+	totalStr := "*"
+	if total >= 0 {
+		totalStr = strconv.FormatInt(total, 10)
+	}
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%s", br.Start, end, totalStr))
+}
+
+// getLength Returns the bytes in the range, -1 if it is open ended
+func (br byteRange) getLength() int64 {
+	if br.End < 0 {
+		return -1
+	}
+	return br.End - br.Start + 1
+}
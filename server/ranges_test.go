@@ -0,0 +1,151 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header string
+		want   byteRange
+		ok     bool
+	}{
+		{"bytes=0-99", byteRange{Start: 0, End: 99}, true},
+		{"bytes=100-", byteRange{Start: 100, End: -1}, true},
+		{"bytes=-100", byteRange{Start: -1, End: 99}, true},
+		{"bytes= 5-5", byteRange{Start: 5, End: 5}, true},
+		{"bytes=10-5", byteRange{}, false},
+		{"bytes=-0", byteRange{}, false},
+		{"bytes=0-1,5-6", byteRange{}, false},
+		{"bytes=a-", byteRange{}, false},
+		{"bytes=-1-", byteRange{}, false},
+		{"bytes=5", byteRange{}, false},
+		{"items=0-1", byteRange{}, false},
+		{"", byteRange{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseRange(tt.header)
+		if ok != tt.ok {
+			t.Errorf("parseRange(%q) ok = %v, want %v", tt.header, ok, tt.ok)
+			continue
+		}
+		if ok && got != tt.want {
+			t.Errorf("parseRange(%q) = %+v, want %+v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestByteRangeResolve(t *testing.T) {
+	tests := []struct {
+		name     string
+		br       byteRange
+		size     int64
+		complete bool
+		want     byteRange
+		ok       bool
+	}{
+		{"complete", byteRange{Start: 10, End: 19}, 100, true, byteRange{Start: 10, End: 19}, true},
+		{"complete open ended", byteRange{Start: 10, End: -1}, 100, true, byteRange{Start: 10, End: 99}, true},
+		{"complete end after size", byteRange{Start: 10, End: 500}, 100, true, byteRange{Start: 10, End: 99}, true},
+		{"complete suffix", byteRange{Start: -1, End: 9}, 100, true, byteRange{Start: 90, End: 99}, true},
+		{"complete suffix bigger than size", byteRange{Start: -1, End: 499}, 100, true, byteRange{Start: 0, End: 99}, true},
+		{"complete start after size", byteRange{Start: 100, End: -1}, 100, true, byteRange{}, false},
+		{"in progress after size", byteRange{Start: 500, End: 599}, 100, false, byteRange{Start: 500, End: 599}, true},
+		{"in progress open ended", byteRange{Start: 10, End: -1}, 100, false, byteRange{Start: 10, End: -1}, true},
+		{"in progress suffix", byteRange{Start: -1, End: 9}, 100, false, byteRange{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := tt.br.resolve(tt.size, tt.complete)
+		if ok != tt.ok {
+			t.Errorf("%s: ok = %v, want %v", tt.name, ok, tt.ok)
+			continue
+		}
+		if ok && got != tt.want {
+			t.Errorf("%s: resolve = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestByteRangeContentRange(t *testing.T) {
+	tests := []struct {
+		br    byteRange
+		total int64
+		want  string
+	}{
+		{byteRange{Start: 10, End: 19}, 100, "bytes 10-19/100"},
+		{byteRange{Start: 10, End: 19}, -1, "bytes 10-19/*"},
+		// Open ended on an in-progress object (RFC 8673)
+		{byteRange{Start: 10, End: -1}, -1, "bytes 10-9007199254740991/*"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		tt.br.setContentRange(w, tt.total)
+		if got := w.Header().Get("Content-Range"); got != tt.want {
+			t.Errorf("setContentRange(%+v, %d) = %q, want %q", tt.br, tt.total, got, tt.want)
+		}
+	}
+}
+
+func TestByteRangeLength(t *testing.T) {
+	if got := (byteRange{Start: 10, End: 19}).getLength(); got != 10 {
+		t.Errorf("getLength = %d, want 10", got)
+	}
+	if got := (byteRange{Start: 10, End: -1}).getLength(); got != -1 {
+		t.Errorf("getLength of open ended = %d, want -1", got)
+	}
+}
+
+// newRangeTestServer Returns a server of the in-progress file f (in Files until the test ends)
+func newRangeTestServer(t *testing.T, f *File) *httptest.Server {
+	FilesLock.Lock()
+	Files[f.Name] = f
+	FilesLock.Unlock()
+	t.Cleanup(func() {
+		FilesLock.Lock()
+		delete(Files, f.Name)
+		FilesLock.Unlock()
+	})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		GetHandler(nil, nil, NewConfig().Egress, NewCors(), "", w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestGetRangeInProgress(t *testing.T) {
+	f := NewFile("/ranges/live.bin", http.Header{}, -1)
+	f.Write([]byte("0123456789"))
+	srv := newRangeTestServer(t, f)
+
+	// The suffix needs the final size
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+f.Name, nil)
+	req.Header.Set("Range", "bytes=-5")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("suffix range on an in-progress object = %d, want 416", resp.StatusCode)
+	}
+
+	// The object completes before the last byte of the range, the response is aborted
+	req.Header.Set("Range", "bytes=5-19")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent || resp.Header.Get("Content-Range") != "bytes 5-19/*" {
+		t.Fatalf("range = %d %q, want 206 bytes 5-19/*", resp.StatusCode, resp.Header.Get("Content-Range"))
+	}
+	f.Write([]byte("abc"))
+	f.Close()
+	if body, err := io.ReadAll(resp.Body); err == nil {
+		t.Errorf("short range body %q read without error", body)
+	}
+}
@@ -0,0 +1,343 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReplicatedHeader Marks the uploads relayed by another server, so they are not relayed again
+const ReplicatedHeader = "Replicated-From"
+
+// ReplicationAbortedTrailer Ends the body of a live relay whose source upload was aborted, so the peer fails
+// the object instead of taking the truncated body as complete
+const ReplicationAbortedTrailer = "Replication-Aborted"
+
+var (
+	errReplicationQueueFull = errors.New("replication queue full")
+	errReplicationAborted   = errors.New("replication aborted by the source")
+)
+
+// replicationPeerTokens Bearer tokens of the peers that relay to this server, replaced by StartHTTPServer
+var replicationPeerTokens = NewConfig().Replication.PeerTokens
+
+// isReplicaUpload Returns true if the upload is relayed by a peer: it has the Replicated-From header and one of
+// the peer tokens (the header alone comes from the client, and it would skip the replication)
+func isReplicaUpload(r *http.Request) bool {
+	return r.Header.Get(ReplicatedHeader) != "" && len(replicationPeerTokens) > 0 && hasValidToken(replicationPeerTokens, r)
+}
+
+// isReplicaAborted Returns true if the body of a replica ended with the abort trailer (only after reading it all)
+func isReplicaAborted(r *http.Request) bool {
+	return isReplicaUpload(r) && r.Trailer.Get(ReplicationAbortedTrailer) != ""
+}
+
+// Replicator Relays every upload, chunk by chunk, to the configured peers
+type Replicator struct {
+	config *Config
+	client *http.Client
+	peers  []*ReplicationPeer
+}
+
+// ReplicationPeer Peer server and its replication stats
+type ReplicationPeer struct {
+	config ReplicationPeerConfig
+	stats  ReplicationStats
+	lock   sync.Mutex
+}
+
+// ReplicationStats Replication metrics of a peer
+type ReplicationStats struct {
+	URL           string  `json:"url"`
+	ActiveUploads int     `json:"activeUploads"`
+	QueuedBytes   int64   `json:"queuedBytes"`
+	SentBytes     int64   `json:"sentBytes"`
+	LagMs         float64 `json:"lagMs"`
+	MaxLagMs      float64 `json:"maxLagMs"`
+	Completed     int64   `json:"completed"`
+	Failed        int64   `json:"failed"`
+	Retries       int64   `json:"retries"`
+	QueueOverflow int64   `json:"queueOverflow"`
+}
+
+// ReplicationUpload One upload being relayed to all the peers
+type ReplicationUpload struct {
+	replicator *Replicator
+	uploads    []*peerUpload
+}
+
+type peerUpload struct {
+	peer    *ReplicationPeer
+	method  string
+	file    *File
+	headers http.Header
+
+	chunks  chan replicationChunk
+	pw      *io.PipeWriter
+	aborted bool
+	done    chan error
+}
+
+type replicationChunk struct {
+	data []byte
+	at   time.Time
+}
+
+// replicationBody Body of a relay, a read error (the abort of the pipe, or the failure of the file) ends it with
+// the abort trailer (instead of dropping the connection, that the peer could take as a complete upload)
+type replicationBody struct {
+	r       io.Reader
+	trailer http.Header
+}
+
+func (b *replicationBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil && err != io.EOF {
+		b.trailer.Set(ReplicationAbortedTrailer, err.Error())
+		return n, io.EOF
+	}
+	return n, err
+}
+
+// NewReplicator Creates a new Replicator object
+func NewReplicator(config *Config) *Replicator {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConnsPerHost:   100,
+		IdleConnTimeout:       90 * time.Second,
+		ResponseHeaderTimeout: time.Duration(config.Replication.TimeoutMs) * time.Millisecond,
+	}
+
+	rep := Replicator{
+		config: config,
+		client: &http.Client{Transport: transport},
+		peers:  []*ReplicationPeer{},
+	}
+	for _, peerConfig := range config.Replication.Peers {
+		rep.peers = append(rep.peers, &ReplicationPeer{
+			config: peerConfig,
+			stats:  ReplicationStats{URL: peerConfig.URL},
+		})
+	}
+
+	return &rep
+}
+
+// GetStats Returns the replication stats of every peer
+func (rep *Replicator) GetStats() []ReplicationStats {
+	ret := []ReplicationStats{}
+	for _, peer := range rep.peers {
+		peer.lock.Lock()
+		ret = append(ret, peer.stats)
+		peer.lock.Unlock()
+	}
+
+	return ret
+}
+
+// StartUpload Starts relaying the upload of f to all the peers, the uploads that are replicas (see isReplicaUpload)
+// must not be relayed again
+func (rep *Replicator) StartUpload(method string, f *File, reqHeaders http.Header) *ReplicationUpload {
+	headers := getHeadersFiltered(reqHeaders)
+	// Relayed body is chunked, and it could be aborted
+	headers.Del("Content-Length")
+	headers.Set(ReplicatedHeader, rep.config.Listen.Address+":"+fmt.Sprint(rep.config.Listen.Port))
+
+	ru := ReplicationUpload{
+		replicator: rep,
+		uploads:    []*peerUpload{},
+	}
+	for _, peer := range rep.peers {
+		pu := &peerUpload{
+			peer:    peer,
+			method:  method,
+			file:    f,
+			headers: headers,
+			chunks:  make(chan replicationChunk, rep.config.Replication.QueueChunks),
+			done:    make(chan error, 1),
+		}
+		pu.start(rep.client)
+		go pu.finish(rep)
+		ru.uploads = append(ru.uploads, pu)
+	}
+
+	return &ru
+}
+
+// Write Queues a chunk for every peer, never blocks (a peer with the queue full is retried from the file)
+func (ru *ReplicationUpload) Write(p []byte) (int, error) {
+	chunk := replicationChunk{
+		data: append([]byte(nil), p...),
+		at:   time.Now(),
+	}
+
+	for _, pu := range ru.uploads {
+		if pu.aborted {
+			continue
+		}
+		select {
+		case pu.chunks <- chunk:
+			pu.peer.lock.Lock()
+			pu.peer.stats.QueuedBytes += int64(len(chunk.data))
+			pu.peer.lock.Unlock()
+		default:
+			logWarnf("REPLICATION %s to %s: %v", pu.file.Name, pu.peer.config.URL, errReplicationQueueFull)
+			pu.peer.lock.Lock()
+			pu.peer.stats.QueueOverflow++
+			pu.peer.lock.Unlock()
+			pu.abort(errReplicationQueueFull)
+		}
+	}
+
+	return len(p), nil
+}
+
+// Close Ends the live relay, once the file is complete
+func (ru *ReplicationUpload) Close() {
+	for _, pu := range ru.uploads {
+		if !pu.aborted {
+			close(pu.chunks)
+		}
+	}
+}
+
+// Abort Aborts the relay to all the peers, once the file failed (so nothing is retried)
+func (ru *ReplicationUpload) Abort() {
+	for _, pu := range ru.uploads {
+		if !pu.aborted {
+			pu.abort(ErrUploadFailed)
+		}
+	}
+}
+
+func (pu *peerUpload) start(client *http.Client) {
+	pr, pw := io.Pipe()
+	pu.pw = pw
+
+	pu.peer.lock.Lock()
+	pu.peer.stats.ActiveUploads++
+	pu.peer.lock.Unlock()
+
+	// Moves the queued chunks to the request body
+	go func() {
+		var errWrite error
+		for chunk := range pu.chunks {
+			pu.peer.lock.Lock()
+			pu.peer.stats.QueuedBytes -= int64(len(chunk.data))
+			pu.peer.stats.LagMs = float64(time.Since(chunk.at)) / float64(time.Millisecond)
+			if pu.peer.stats.LagMs > pu.peer.stats.MaxLagMs {
+				pu.peer.stats.MaxLagMs = pu.peer.stats.LagMs
+			}
+			pu.peer.lock.Unlock()
+
+			if errWrite != nil {
+				// Just drain
+				continue
+			}
+			var n int
+			n, errWrite = pw.Write(chunk.data)
+
+			pu.peer.lock.Lock()
+			pu.peer.stats.SentBytes += int64(n)
+			pu.peer.lock.Unlock()
+		}
+		pw.Close()
+	}()
+
+	go func() {
+		// The trailer keys are announced in the request headers
+		body := &replicationBody{r: pr, trailer: http.Header{ReplicationAbortedTrailer: nil}}
+		err := pu.send(client, body, body.trailer)
+		// Unblocks the chunks pump if the request ended before reading all the body
+		pr.Close()
+		pu.done <- err
+	}()
+}
+
+func (pu *peerUpload) abort(err error) {
+	pu.aborted = true
+	pu.pw.CloseWithError(err)
+	close(pu.chunks)
+}
+
+func (pu *peerUpload) send(client *http.Client, body io.Reader, trailer http.Header) error {
+	req, err := http.NewRequest(pu.method, strings.TrimSuffix(pu.peer.config.URL, "/")+pu.file.Name, body)
+	if err != nil {
+		return err
+	}
+	req.Trailer = trailer
+	for header, values := range pu.headers {
+		for _, value := range values {
+			req.Header.Add(header, value)
+		}
+	}
+	if pu.peer.config.AuthToken != "" {
+		req.Header.Set("Authorization", "Bearer "+pu.peer.config.AuthToken)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("peer returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// finish Waits for the live relay and, if it failed, sends the file again from the start. If the upload is still in
+// progress the file is read as any live reader does, so the peer gets the live object again without waiting for
+// the upload to complete. Nothing is retried once the upload failed
+func (pu *peerUpload) finish(rep *Replicator) {
+	err := <-pu.done
+
+	backoff := time.Duration(rep.config.Replication.BackoffMs) * time.Millisecond
+	maxBackoff := time.Duration(rep.config.Replication.MaxBackoffMs) * time.Millisecond
+	for retry := 1; err != nil && !pu.file.IsFailed() && retry <= rep.config.Replication.MaxRetries; retry++ {
+		logWarnf("REPLICATION %s to %s failed: %v, retry %d in %v", pu.file.Name, pu.peer.config.URL, err, retry, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+
+		pu.peer.lock.Lock()
+		pu.peer.stats.Retries++
+		pu.peer.lock.Unlock()
+
+		rc, errOpen := pu.file.OpenReadCloser(rep.config.Storage.BasePath, nil)
+		if errOpen != nil {
+			// Removed meanwhile
+			err = errOpen
+			break
+		}
+		// If the upload fails while it is sent, the body ends with the abort trailer
+		body := &replicationBody{r: rc, trailer: http.Header{ReplicationAbortedTrailer: nil}}
+		err = pu.send(rep.client, body, body.trailer)
+		rc.Close()
+	}
+
+	pu.peer.lock.Lock()
+	defer pu.peer.lock.Unlock()
+
+	pu.peer.stats.ActiveUploads--
+	if err != nil {
+		logWarnf("REPLICATION %s to %s gave up: %v", pu.file.Name, pu.peer.config.URL, err)
+		pu.peer.stats.Failed++
+		return
+	}
+	pu.peer.stats.Completed++
+}
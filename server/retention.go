@@ -0,0 +1,73 @@
+package server
+
+import (
+	"path"
+	"strings"
+	"time"
+)
+
+// Retention Decides when files are removed by the clean up: the first matching rule applies,
+// and the files that do not match any rule use the original Cache-Control (max-age) header
+type Retention struct {
+	rules     []RetentionRule
+	useMaxAge bool
+	onlyRAM   bool
+}
+
+// NewRetention Creates a new Retention object
+func NewRetention(config *Config) *Retention {
+	return &Retention{
+		rules:     config.Retention.Rules,
+		useMaxAge: config.Cleanup.Enabled,
+		onlyRAM:   config.Storage.OnlyRAM,
+	}
+}
+
+// IsEnabled Returns true if there is anything to clean up
+func (rt *Retention) IsEnabled() bool {
+	return rt.useMaxAge || len(rt.rules) > 0
+}
+
+func (rt *Retention) getRule(key string) *RetentionRule {
+	for i := range rt.rules {
+		if rt.rules[i].matches(key) {
+			return &rt.rules[i]
+		}
+	}
+	return nil
+}
+
+func (rule *RetentionRule) matches(key string) bool {
+	return matchesKey(rule.Match, key)
+}
+
+// matchesKey Match is a glob (path.Match syntax) if it contains any of *?[, otherwise a prefix
+func matchesKey(match string, key string) bool {
+	if !strings.ContainsAny(match, "*?[") {
+		return strings.HasPrefix(key, match)
+	}
+
+	keyPath := key
+	if idx := strings.Index(keyPath, "?"); idx >= 0 {
+		keyPath = keyPath[:idx]
+	}
+	matched, err := path.Match(match, keyPath)
+	return err == nil && matched
+}
+
+func (rule *RetentionRule) getMaxAge() time.Duration {
+	return time.Duration(rule.MaxAgeS * float64(time.Second))
+}
+
+// hasGroupLimits Returns true if the rule limits depend on the other matching files
+func (rule *RetentionRule) hasGroupLimits() bool {
+	return rule.MaxObjects > 0 || rule.MaxTotalBytes > 0 || rule.KeepLastN > 0
+}
+
+// getGroupKey Files with the same group key share the rule limits
+func (rule *RetentionRule) getGroupKey(key string) string {
+	if rule.PerDirectory {
+		return rule.Match + "|" + path.Dir(key)
+	}
+	return rule.Match
+}
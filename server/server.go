@@ -1,55 +1,194 @@
 package server
 
 import (
+	"context"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
 )
 
-var (
-	cleanUpChannel = make(chan bool)
-)
-
 // StartHTTPServer Starts the webserver
-func StartHTTPServer(basePath string, port int, certFilePath string, keyFilePath string, corsConfigFilePath string, onlyRAM bool, doCleanupBasedOnCacheHeaders bool, waitForDataToArrive bool) error {
+func StartHTTPServer(config *Config) error {
 	var err error
 
+	err = config.Validate()
+	if err != nil {
+		return err
+	}
+
+	logLevel, _ := ParseLevel(config.Log.Level)
+	SetLogLevel(logLevel)
+	if config.Log.FilePath != "" {
+		logOut, err := NewLogOutput(config.Log.FilePath, config.Log.MaxSizeMB, config.Log.MaxBackups)
+		if err != nil {
+			return err
+		}
+		log.SetOutput(logOut)
+	}
+
+	headerPolicy = NewHeaderPolicy(config.Headers)
+	contentTypes = NewContentTypes(config.ContentTypes)
+	mediaIndexes = config.Index
+	replicationPeerTokens = config.Replication.PeerTokens
+
+	basePath := config.Storage.BasePath
+	onlyRAM := config.Storage.OnlyRAM
+
 	cors := NewCors()
-	if corsConfigFilePath != "" {
+	if config.Cors.FilePath != "" {
 		// Loads CORS config
-		err = cors.LoadFromDisc(corsConfigFilePath)
+		err = cors.LoadFromDisc(config.Cors.FilePath)
 		if err != nil {
 			return err
 		}
+	} else if cors.LoadFromData(config.Cors.CorsData) {
+		log.Printf("CORS policy from config applied")
 	} else {
 		log.Printf("CORS default policy applied")
 	}
 	log.Printf("CORS: %s", cors.String())
 
 	var waitingRequests *WaitingRequests = nil
-	if waitForDataToArrive {
+	if config.WaitingRequests.Enabled {
 		log.Printf("Using waiting requests map")
-		waitingRequests = NewWaitingRequests()
+		waitingRequests = NewWaitingRequests(time.Duration(config.WaitingRequests.ExpirationMs)*time.Millisecond, time.Duration(config.WaitingRequests.CleanUpEveryMs)*time.Millisecond)
+	}
+
+	var upstream *Upstream = nil
+	if config.Upstream.URL != "" {
+		log.Printf("Edge mode, pulling misses from %s", config.Upstream.URL)
+		upstream = NewUpstream(config, waitingRequests)
+	}
+
+	var replicator *Replicator = nil
+	if len(config.Replication.Peers) > 0 {
+		log.Printf("Replicating uploads to %d peers", len(config.Replication.Peers))
+		replicator = NewReplicator(config)
+	}
+
+	var webhooks *Webhooks = nil
+	if len(config.Webhooks.Hooks) > 0 {
+		webhooks = NewWebhooks(config)
+		webhooks.Start()
+	}
+
+	var hls *HLS = nil
+	if len(config.HLS.Streams) > 0 {
+		log.Printf("Generating HLS playlists for %d segment patterns", len(config.HLS.Streams))
+		hls = NewHLS(config, waitingRequests)
+		hls.Start()
+	}
+
+	var dash *DASH = nil
+	if len(config.DASH.Streams) > 0 {
+		log.Printf("Generating DASH MPDs for %d streams", len(config.DASH.Streams))
+		dash = NewDASH(config, waitingRequests)
+		dash.Start()
 	}
 
+	var handler http.Handler
 	r := mux.NewRouter()
+	handler = r
+	if config.Log.AccessLog.Enabled {
+		accessLogOut, err := NewLogOutput(config.Log.AccessLog.FilePath, config.Log.AccessLog.MaxSizeMB, config.Log.AccessLog.MaxBackups)
+		if err != nil {
+			return err
+		}
+		accessLogLevel, _ := ParseLevel(config.Log.AccessLog.Level)
+		handler = NewAccessLogger(accessLogOut, accessLogLevel).Handler(r)
+	}
+
+	health := NewHealth(config)
+	if config.Health.Enabled {
+		log.Printf("Health endpoints on %s and %s", config.Health.LivenessPath, config.Health.ReadinessPath)
+		health.AddRoutes(r)
+	}
+
+	if config.Events.Enabled {
+		log.Printf("Lifecycle events on %s", config.Events.Path)
+		r.Path(config.Events.Path).Methods(http.MethodGet).HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !hasValidToken(config.Auth.EgressTokens, r) {
+				addCors(w, cors)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			EventsHandler(config.Events.QueueSize, cors, w, r)
+		})
+	}
+
+	servers := []gracefulServer{}
+	if config.Admin.Enabled {
+		admin := NewAdmin(config, waitingRequests, replicator, webhooks, hls, dash)
+		if config.Admin.Port > 0 {
+			adminRouter := mux.NewRouter()
+			admin.AddRoutes(adminRouter)
+			adminServer := &http.Server{
+				Addr:    config.Admin.Address + ":" + strconv.Itoa(config.Admin.Port),
+				Handler: adminRouter,
+			}
+			servers = append(servers, adminServer)
+			go func() {
+				log.Printf("HTTP admin server running on %s", adminServer.Addr)
+				log.Printf("HTTP admin server exited: %v", adminServer.ListenAndServe())
+			}()
+		} else {
+			log.Printf("HTTP admin API under %s", config.Admin.PathPrefix)
+			admin.AddRoutes(r)
+		}
+	}
 
 	r.PathPrefix("/").Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logDebugf("%s %s", r.Method, getLogKey(r.URL))
+		if IsWebSocketIngestRequest(config.Ingest, r) {
+			if !isWebSocketIngestAuthorized(config.Auth, r) {
+				addCors(w, cors)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			// The connection is hijacked, there is nothing to flush after
+			WebSocketIngestHandler(waitingRequests, replicator, config.Ingest, onlyRAM, cors, basePath, w, r)
+			return
+		}
+		if r.Method == http.MethodGet && IsWebSocketRequest(r) {
+			if !isWebSocketEgressAuthorized(config.Auth, r) {
+				addCors(w, cors)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			// The connection is hijacked, there is nothing to flush after
+			WebSocketGetHandler(waitingRequests, upstream, config.Egress, cors, basePath, w, r)
+			return
+		}
+		if !isAuthorized(config.Auth, r) {
+			addCors(w, cors)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
 		defer w.(http.Flusher).Flush()
-		log.Printf("%s %s", r.Method, r.URL.String())
 		switch r.Method {
 		case http.MethodGet:
-			GetHandler(waitingRequests, cors, basePath, w, r)
+			if IsListRequest(r) {
+				ListHandler(cors, w, r)
+				return
+			}
+			GetHandler(waitingRequests, upstream, config.Egress, cors, basePath, w, r)
 		case http.MethodHead:
 			HeadHandler(cors, w, r)
 		case http.MethodPost:
-			PostHandler(waitingRequests, onlyRAM, cors, basePath, w, r)
+			PostHandler(waitingRequests, replicator, config.Ingest, onlyRAM, cors, basePath, w, r)
 		case http.MethodPut:
-			PutHandler(waitingRequests, onlyRAM, cors, basePath, w, r)
+			PutHandler(waitingRequests, replicator, config.Ingest, onlyRAM, cors, basePath, w, r)
 		case http.MethodDelete:
+			if IsPrefixDeleteRequest(r) {
+				DeletePrefixHandler(onlyRAM, cors, basePath, w, r)
+				return
+			}
 			DeleteHandler(onlyRAM, cors, basePath, w, r)
 		case http.MethodOptions:
 			OptionsHandler(cors, w, r)
@@ -58,89 +197,124 @@ func StartHTTPServer(basePath string, port int, certFilePath string, keyFilePath
 		}
 	})).Methods(http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodOptions)
 
-	if doCleanupBasedOnCacheHeaders {
-		startCleanUp(basePath, 1000)
+	retention := NewRetention(config)
+	if retention.IsEnabled() {
+		fileExpiry = NewExpiryScheduler(retention, basePath, time.Duration(config.Cleanup.PeriodMs)*time.Millisecond)
+		fileExpiry.Start()
+	}
+
+	mainServer := &http.Server{
+		Addr:        config.Listen.Address + ":" + strconv.Itoa(config.Listen.Port),
+		Handler:     handler,
+		ConnContext: saveConnInContext,
+	}
+	configureHTTP2(mainServer, config)
+	// Long lived event streams would delay the graceful shutdown
+	mainServer.RegisterOnShutdown(objectEvents.CloseSubscriptions)
+	servers = append(servers, mainServer)
+
+	if config.HTTP3.Enabled {
+		h3Server := newHTTP3Server(config, handler)
+		mainServer.Handler = altSvcHandler(config, handler)
+		servers = append(servers, h3Server)
+		go func() {
+			log.Printf("HTTP/3 server running on %s (UDP)", h3Server.Addr)
+			err := h3Server.ListenAndServeTLS(config.TLS.CertFile, config.TLS.KeyFile)
+			if err != nil && err != http.ErrServerClosed {
+				logWarnf("HTTP/3 server error: %v", err)
+			}
+		}()
 	}
 
-	if (certFilePath != "") && (keyFilePath != "") {
+	stopShutdownOnSignal := shutdownOnSignal(config, health, servers)
+	defer stopShutdownOnSignal()
+
+	if (config.TLS.CertFile != "") && (config.TLS.KeyFile != "") {
 		// Try HTTPS
-		log.Printf("HTTPS server running on port %d", port)
-		err = http.ListenAndServeTLS(":"+strconv.Itoa(port), certFilePath, keyFilePath, r)
+		log.Printf("HTTPS server running on %s", mainServer.Addr)
+		err = mainServer.ListenAndServeTLS(config.TLS.CertFile, config.TLS.KeyFile)
 	} else {
 		// Try HTTP
-		log.Printf("HTTP server running on port %d", port)
-		err = http.ListenAndServe(":"+strconv.Itoa(port), r)
+		log.Printf("HTTP server running on %s", mainServer.Addr)
+		err = mainServer.ListenAndServe()
+	}
+	if err == http.ErrServerClosed {
+		// Graceful shutdown
+		err = nil
 	}
 
-	if doCleanupBasedOnCacheHeaders {
-		stopCleanUp()
+	if fileExpiry != nil {
+		fileExpiry.Stop()
+		fileExpiry = nil
 	}
 	if waitingRequests != nil {
 		waitingRequests.Close()
 	}
+	if webhooks != nil {
+		webhooks.Stop()
+	}
+	if hls != nil {
+		hls.Stop()
+	}
+	if dash != nil {
+		dash.Stop()
+	}
 
 	return err
 }
 
-func startCleanUp(basePath string, periodMs int64) {
-	go runCleanupEvery(basePath, periodMs, cleanUpChannel)
+// configureHTTP2 Sets the protocols (h2 over TLS, h2c over plaintext) and the HTTP/2 settings of the server
+func configureHTTP2(srv *http.Server, config *Config) {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(config.HTTP2.Enabled)
+	protocols.SetUnencryptedHTTP2(config.HTTP2.Enabled && config.HTTP2.H2C)
+	srv.Protocols = protocols
 
-	log.Printf("HTTP Started clean up thread")
+	srv.HTTP2 = &http.HTTP2Config{
+		MaxConcurrentStreams:          config.HTTP2.MaxConcurrentStreams,
+		MaxReadFrameSize:              config.HTTP2.MaxReadFrameSize,
+		MaxReceiveBufferPerConnection: config.HTTP2.MaxReceiveBufferPerConnection,
+		MaxReceiveBufferPerStream:     config.HTTP2.MaxReceiveBufferPerStream,
+		PingTimeout:                   time.Duration(config.HTTP2.PingTimeoutMs) * time.Millisecond,
+	}
 }
 
-func stopCleanUp() {
-	// Send finish signal
-	cleanUpChannel <- true
-
-	// Wait to finish
-	<-cleanUpChannel
-
-	log.Printf("HTTP Stopped clean up thread")
+// gracefulServer Server that is shut down on signal (HTTP/1.1 and HTTP/2, or HTTP/3)
+type gracefulServer interface {
+	Shutdown(ctx context.Context) error
+	Close() error
 }
 
-func runCleanupEvery(basePath string, periodMs int64, cleanUpChannelBidi chan bool) {
-	timeCh := time.NewTicker(time.Millisecond * time.Duration(periodMs))
-	exit := false
+// shutdownOnSignal On SIGINT / SIGTERM fails readiness, waits the drain delay and gracefully shuts down servers
+func shutdownOnSignal(config *Config, health *Health, servers []gracefulServer) (stop func()) {
+	signals := make(chan os.Signal, 1)
+	done := make(chan bool)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 
-	for !exit {
+	go func() {
 		select {
-		// Wait for the next tick
-		case tm := <-timeCh.C:
-			cacheCleanUp(basePath, tm)
-
-		case <-cleanUpChannelBidi:
-			exit = true
+		case sig := <-signals:
+			log.Printf("Received %v, draining for %dms", sig, config.Health.DrainDelayMs)
+		case <-done:
+			return
 		}
-	}
-	// Indicates finished
-	cleanUpChannelBidi <- true
+		health.SetDraining()
+		time.Sleep(time.Duration(config.Health.DrainDelayMs) * time.Millisecond)
 
-	log.Printf("HTTP Exited clean up thread")
-}
-
-func cacheCleanUp(basePath string, now time.Time) {
-	filesToDel := map[string]*File{}
-
-	// TODO: This is a brute force approach, optimization recommended
-
-	FilesLock.Lock()
-	defer FilesLock.Unlock()
-
-	// Check for expired files
-	for key, file := range Files {
-		if file.maxAgeS >= 0 && file.eof {
-			if file.receivedAt.Add(time.Second * time.Duration(file.maxAgeS)).Before(now) {
-				filesToDel[key] = file
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.Health.ShutdownTimeoutMs)*time.Millisecond)
+		defer cancel()
+		for _, srv := range servers {
+			err := srv.Shutdown(ctx)
+			if err != nil {
+				logWarnf("Error shutting down server: %v", err)
+				srv.Close()
 			}
 		}
-	}
-	// Delete expired files
-	for keyToDel, fileToDel := range filesToDel {
-		// Delete from array
-		delete(Files, keyToDel)
-		if fileToDel.onDisk {
-			fileToDel.RemoveFromDisk(basePath)
-		}
-		log.Printf("CLEANUP expired, deleted: %s", keyToDel)
+	}()
+
+	return func() {
+		signal.Stop(signals)
+		close(done)
 	}
 }
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// readWithTimeout Reads exactly n bytes, failing the test if they do not arrive in time
+func readWithTimeout(t *testing.T, r io.Reader, n int) string {
+	t.Helper()
+
+	type result struct {
+		b   []byte
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		b := make([]byte, n)
+		_, err := io.ReadFull(r, b)
+		ch <- result{b, err}
+	}()
+
+	select {
+	case res := <-ch:
+		if res.err != nil {
+			t.Fatalf("read: %v", res.err)
+		}
+		return string(res.b)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%d bytes not received in time", n)
+	}
+	return ""
+}
+
+// TestH2CChunkFlush Every chunk of an in-progress object is sent (as a DATA frame) when it is received, with h2c
+func TestH2CChunkFlush(t *testing.T) {
+	config := NewConfig()
+	config.HTTP2.H2C = true
+	cors := NewCors()
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		GetHandler(nil, nil, config.Egress, cors, "", w, r)
+	}))
+	configureHTTP2(srv.Config, config)
+	srv.Start()
+	defer srv.Close()
+
+	f := NewFile("/h2c/live.bin", http.Header{}, -1)
+	FilesLock.Lock()
+	Files[f.Name] = f
+	FilesLock.Unlock()
+	defer func() {
+		FilesLock.Lock()
+		delete(Files, f.Name)
+		FilesLock.Unlock()
+	}()
+	f.Write([]byte("first"))
+
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}, Timeout: 10 * time.Second}
+	resp, err := client.Get(srv.URL + f.Name)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("protocol %s, want HTTP/2", resp.Proto)
+	}
+
+	// The chunks arrive while the object is in progress, not when it completes
+	if got := readWithTimeout(t, resp.Body, 5); got != "first" {
+		t.Errorf("first chunk %q", got)
+	}
+	f.Write([]byte("second"))
+	if got := readWithTimeout(t, resp.Body, 6); got != "second" {
+		t.Errorf("second chunk %q", got)
+	}
+	f.Close()
+	if rest, err := io.ReadAll(resp.Body); err != nil || len(rest) != 0 {
+		t.Errorf("end of the body %q %v", rest, err)
+	}
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers NOT stored from the upstream response (hop-by-hop or recomputed locally)
+var upstreamSkipHeaders = []string{"Connection", "Keep-Alive", "Transfer-Encoding", "Trailer", "Upgrade", "Content-Length", "Date", "Waited-For-Data-Ms"}
+
+// Upstream Pulls the objects not present locally from an upstream (origin) server
+type Upstream struct {
+	config          *Config
+	waitingRequests *WaitingRequests
+	client          *http.Client
+
+	pulls     map[string]*upstreamPull
+	pullsLock sync.Mutex
+}
+
+// upstreamPull In flight request to upstream, shared by all the GETs of the same key
+type upstreamPull struct {
+	done chan bool
+	file *File
+}
+
+// NewUpstream Creates a new Upstream object
+func NewUpstream(config *Config, waitingRequests *WaitingRequests) *Upstream {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConnsPerHost:   100,
+		IdleConnTimeout:       90 * time.Second,
+		ResponseHeaderTimeout: time.Duration(config.Upstream.TimeoutMs) * time.Millisecond,
+	}
+
+	return &Upstream{
+		config:          config,
+		waitingRequests: waitingRequests,
+		client:          &http.Client{Transport: transport},
+		pulls:           map[string]*upstreamPull{},
+	}
+}
+
+// Pull Returns the local file for name, requesting it from upstream if this is the first miss.
+// The file is returned as soon as upstream answers, and it is filled while the upstream body arrives. If ctx is done
+// first it returns without the file, and the upstream request goes on for the other readers
+func (u *Upstream) Pull(ctx context.Context, name string, headers http.Header) (*File, bool) {
+	u.pullsLock.Lock()
+	pull, exists := u.pulls[name]
+	if !exists {
+		// It could have been completed between the caller miss and here
+		FilesLock.RLock()
+		f, ok := Files[name]
+		FilesLock.RUnlock()
+		if ok {
+			u.pullsLock.Unlock()
+			return f, true
+		}
+
+		pull = &upstreamPull{done: make(chan bool)}
+		u.pulls[name] = pull
+		go u.fetch(name, headers, pull)
+	}
+	u.pullsLock.Unlock()
+
+	select {
+	case <-pull.done:
+	case <-ctx.Done():
+		return nil, false
+	}
+
+	return pull.file, pull.file != nil
+}
+
+func (u *Upstream) fetch(name string, headers http.Header, pull *upstreamPull) {
+	resp, err := u.doRequest(name, headers)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		if err != nil {
+			logWarnf("UPSTREAM %s error: %v", name, err)
+		} else {
+			logDebugf("UPSTREAM %s returned %d", name, resp.StatusCode)
+			resp.Body.Close()
+		}
+		u.endPull(name, pull)
+		return
+	}
+	defer resp.Body.Close()
+
+	f := NewFile(name, getUpstreamHeadersFiltered(resp.Header), getMaxAgeOr(resp.Header.Get("Cache-Control"), -1))
+
+	FilesLock.Lock()
+	Files[name] = f
+	FilesLock.Unlock()
+
+	pull.file = f
+	u.endPull(name, pull)
+
+	// Stalled upstream responses are aborted
+	watchdog := watchIngest(f, time.Duration(u.config.Ingest.IdleTimeoutMs)*time.Millisecond, time.Duration(u.config.Ingest.MaxDurationMs)*time.Millisecond, func(err error) {
+		logWarnf("UPSTREAM %s aborted: %v", name, err)
+		resp.Body.Close()
+	})
+
+	// Fill the file while the readers are already reading from it
+	_, err = io.Copy(f, resp.Body)
+	watchdog.Stop()
+	if err != nil {
+		// Incomplete, next GET will request it again
+		logWarnf("UPSTREAM %s body error: %v", name, err)
+		failUpload(f)
+		return
+	}
+	f.Close()
+	logDebugf("UPSTREAM %s completed", name)
+
+	if !u.config.Storage.OnlyRAM {
+		err := f.WriteToDisk(u.config.Storage.BasePath)
+		if err != nil {
+			logWarnf("Error saving %s to disk: %v", name, err)
+		}
+	}
+	scheduleExpiry(f)
+
+	if u.waitingRequests != nil {
+		u.waitingRequests.ReceivedDataFor(name)
+	}
+}
+
+func (u *Upstream) doRequest(name string, headers http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, strings.TrimSuffix(u.config.Upstream.URL, "/")+name, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, header := range u.config.Upstream.ForwardHeaders {
+		if value := headers.Get(header); value != "" {
+			req.Header.Set(header, value)
+		}
+	}
+	if u.config.Upstream.AuthToken != "" {
+		req.Header.Set("Authorization", "Bearer "+u.config.Upstream.AuthToken)
+	}
+
+	return u.client.Do(req)
+}
+
+func (u *Upstream) endPull(name string, pull *upstreamPull) {
+	u.pullsLock.Lock()
+	delete(u.pulls, name)
+	u.pullsLock.Unlock()
+
+	close(pull.done)
+}
+
+func getUpstreamHeadersFiltered(headers http.Header) http.Header {
+	ret := headers.Clone()
+
+	for _, header := range upstreamSkipHeaders {
+		ret.Del(header)
+	}
+	for header := range ret {
+		if strings.HasPrefix(header, "Access-Control-") {
+			// Local CORS policy applies
+			ret.Del(header)
+		}
+	}
+
+	return ret
+}
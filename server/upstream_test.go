@@ -0,0 +1,35 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestUpstreamPullContext(t *testing.T) {
+	release := make(chan bool)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte("data"))
+	}))
+	defer origin.Close()
+	defer close(release)
+
+	config := NewConfig()
+	config.Upstream.URL = origin.URL
+	config.Storage.OnlyRAM = true
+	u := NewUpstream(config, nil)
+
+	// The reader that is gone does not wait for the upstream response
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if f, ok := u.Pull(ctx, "/upstream/slow.bin", http.Header{}); ok || f != nil {
+		t.Errorf("Pull with a done context = %v %v, want nil false", f, ok)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Pull returned after %v", elapsed)
+	}
+}
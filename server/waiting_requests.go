@@ -24,6 +24,10 @@ type WaitingRequests struct {
 	requests     map[string]*WaitingRequestArrayBlock
 	requestsLock sync.RWMutex
 
+	expiration time.Duration
+	// expirationRules Default expiration of some names (Ex: DASH segments), the first rule that returns true applies
+	expirationRules []func(name string) (time.Duration, bool)
+
 	cleanUpChannelBidi chan bool
 }
 
@@ -40,14 +44,15 @@ type WaitingRequest struct {
 	channelBidi chan int
 }
 
-// NewCors Creates a new Cors object
-func NewWaitingRequests() *WaitingRequests {
+// NewWaitingRequests Creates a new WaitingRequests object
+func NewWaitingRequests(expiration time.Duration, cleanUpEvery time.Duration) *WaitingRequests {
 	brs := WaitingRequests{
 		requests:           map[string]*WaitingRequestArrayBlock{},
+		expiration:         expiration,
 		cleanUpChannelBidi: make(chan bool),
 	}
 
-	go brs.runRequestCleanupEvery(defaultRequestCleanUpEvery)
+	go brs.runRequestCleanupEvery(cleanUpEvery)
 
 	return &brs
 }
@@ -57,14 +62,15 @@ func (brs *WaitingRequests) AddWaitingRequest(name string, headers http.Header)
 	found = false
 	nowStart := time.Now()
 	// This is modified Expires, instead of HTTP-date timestamp uses duration in seconds (Ex: "Expires: in=10")
-	expiration := brs.getExpiresInOr(headers.Get("Expires"), defaultRequestExpiration)
+	expiration := brs.getExpiresInOr(headers.Get("Expires"), brs.getDefaultExpiration(name))
 
 	uidStr := uuid.New().String()
 	br := WaitingRequest{
 		uidStr:       uidStr,
 		receivedAt:   nowStart,
 		expirationAt: nowStart.Add(expiration),
-		channelBidi:  make(chan int),
+		// Buffered, the signal never blocks the goroutine that holds requestsLock
+		channelBidi: make(chan int, 1),
 	}
 
 	brs.requestsLock.Lock()
@@ -110,15 +116,59 @@ func (brs *WaitingRequests) ReceivedDataFor(name string) {
 	brs.requestsLock.Lock()
 	defer brs.requestsLock.Unlock()
 
-	for nameWaiting, reqArrayBlock := range brs.requests {
-		if name == nameWaiting {
-			for _, bReq := range reqArrayBlock.requests {
-				if now.Before(bReq.expirationAt) {
-					brs.responseRequest(bReq)
-				}
-			}
+	reqArrayBlock, exists := brs.requests[name]
+	if !exists {
+		return
+	}
+	// Signaled requests are removed here, so they are not signaled again (Ex: playlist rewrites) before they
+	// remove themselves
+	pending := []*WaitingRequest{}
+	for _, bReq := range reqArrayBlock.requests {
+		if now.Before(bReq.expirationAt) {
+			brs.responseRequest(bReq)
+		} else {
+			pending = append(pending, bReq)
+		}
+	}
+	reqArrayBlock.requests = pending
+	if len(pending) <= 0 {
+		delete(brs.requests, name)
+	}
+}
+
+// GetWaitingCounts Returns the number of waiting requests per name
+func (brs *WaitingRequests) GetWaitingCounts() map[string]int {
+	brs.requestsLock.RLock()
+	defer brs.requestsLock.RUnlock()
+
+	ret := map[string]int{}
+	for name, reqArrayBlock := range brs.requests {
+		ret[name] = len(reqArrayBlock.requests)
+	}
+
+	return ret
+}
+
+// AddExpirationRule Sets the default expiration of the names the rule returns true for, the Expires header of the
+// request still overrides it
+func (brs *WaitingRequests) AddExpirationRule(rule func(name string) (time.Duration, bool)) {
+	brs.requestsLock.Lock()
+	defer brs.requestsLock.Unlock()
+
+	brs.expirationRules = append(brs.expirationRules, rule)
+}
+
+func (brs *WaitingRequests) getDefaultExpiration(name string) time.Duration {
+	brs.requestsLock.RLock()
+	rules := brs.expirationRules
+	brs.requestsLock.RUnlock()
+
+	for _, rule := range rules {
+		if expiration, ok := rule(name); ok {
+			return expiration
 		}
 	}
+	return brs.expiration
 }
 
 func (brs *WaitingRequests) getExpiresInOr(s string, def time.Duration) time.Duration {
@@ -159,10 +209,10 @@ func (brs *WaitingRequests) runRequestCleanupEvery(period time.Duration) {
 
 func (brs *WaitingRequests) stopCleanUp() {
 	// Send finish signal
-	cleanUpChannel <- true
+	brs.cleanUpChannelBidi <- true
 
 	// Wait to finish
-	<-cleanUpChannel
+	<-brs.cleanUpChannelBidi
 }
 
 func (brs *WaitingRequests) expireRequests(now time.Time) {
@@ -171,21 +221,31 @@ func (brs *WaitingRequests) expireRequests(now time.Time) {
 	defer brs.requestsLock.Unlock()
 
 	for name, reqArrayBlock := range brs.requests {
-		for i, bReq := range reqArrayBlock.requests {
-			// Add expired requests to delete array
+		pending := []*WaitingRequest{}
+		for _, bReq := range reqArrayBlock.requests {
 			if now.After(bReq.expirationAt) {
-				brs.cancelRequest(brs.requests[name].requests[i])
+				brs.cancelRequest(bReq)
+			} else {
+				pending = append(pending, bReq)
 			}
 		}
+		reqArrayBlock.requests = pending
+		if len(pending) <= 0 {
+			delete(brs.requests, name)
+		}
 	}
 }
 
 func (brs *WaitingRequests) cancelRemoveAllRequests() {
+	brs.requestsLock.Lock()
+	defer brs.requestsLock.Unlock()
+
 	for _, reqArrayBlock := range brs.requests {
 		for _, bReq := range reqArrayBlock.requests {
 			brs.cancelRequest(bReq)
 		}
 	}
+	brs.requests = map[string]*WaitingRequestArrayBlock{}
 }
 
 func (brs *WaitingRequests) removeRequestByUID(name string, uidStr string) {
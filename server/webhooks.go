@@ -0,0 +1,245 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Webhook request headers
+const (
+	WebhookEventHeader     = "Webhook-Event"
+	WebhookSignatureHeader = "Webhook-Signature"
+)
+
+// Webhooks POSTs the lifecycle events to the configured hooks. Every hook has its own bounded queue and
+// sender, so a slow receiver only delays (or drops) its own events and never the ingest
+type Webhooks struct {
+	config       *Config
+	client       *http.Client
+	hooks        []*webhook
+	subscription *EventSubscription
+	exit         chan bool
+	wg           sync.WaitGroup
+}
+
+type webhook struct {
+	config WebhookConfig
+	events map[string]bool
+	queue  chan ObjectEvent
+	stats  WebhookStats
+	lock   sync.Mutex
+}
+
+// WebhookStats Delivery metrics of a hook
+type WebhookStats struct {
+	URL       string `json:"url"`
+	Queued    int    `json:"queued"`
+	Delivered int64  `json:"delivered"`
+	Failed    int64  `json:"failed"`
+	Retries   int64  `json:"retries"`
+	Dropped   int64  `json:"dropped"`
+}
+
+// WebhookPayload Body POSTed to the hooks
+type WebhookPayload struct {
+	ObjectEvent
+	DurationMs float64 `json:"durationMs"`
+}
+
+// getWebhookEventType Returns the lifecycle event type of a configured one ("aborted" is an alias of "failed"), empty if unknown
+func getWebhookEventType(eventType string) string {
+	switch eventType {
+	case EventCreated, EventFirstByte, EventCompleted, EventFailed, EventDeleted, EventExpired:
+		return eventType
+	case "aborted":
+		return EventFailed
+	}
+	return ""
+}
+
+// NewWebhooks Creates a new Webhooks object
+func NewWebhooks(config *Config) *Webhooks {
+	wh := Webhooks{
+		config: config,
+		client: &http.Client{Timeout: time.Duration(config.Webhooks.TimeoutMs) * time.Millisecond},
+		hooks:  []*webhook{},
+		exit:   make(chan bool),
+	}
+	for _, hookConfig := range config.Webhooks.Hooks {
+		hook := &webhook{
+			config: hookConfig,
+			events: map[string]bool{},
+			queue:  make(chan ObjectEvent, config.Webhooks.QueueSize),
+			stats:  WebhookStats{URL: hookConfig.URL},
+		}
+		for _, eventType := range hookConfig.Events {
+			hook.events[getWebhookEventType(eventType)] = true
+		}
+		wh.hooks = append(wh.hooks, hook)
+	}
+
+	return &wh
+}
+
+// Start Subscribes to the lifecycle events and starts the senders
+func (wh *Webhooks) Start() {
+	// Lossless, the events are only dropped by dispatch (per hook, so they are counted in its stats)
+	wh.subscription = objectEvents.SubscribeLossless("")
+
+	wh.wg.Add(1)
+	go wh.dispatch()
+	for _, hook := range wh.hooks {
+		wh.wg.Add(1)
+		go wh.send(hook)
+	}
+
+	log.Printf("HTTP Started webhooks for %d hooks", len(wh.hooks))
+}
+
+// Stop Stops the senders, the events still queued are discarded
+func (wh *Webhooks) Stop() {
+	objectEvents.Unsubscribe(wh.subscription)
+	close(wh.exit)
+	wh.wg.Wait()
+
+	log.Printf("HTTP Stopped webhooks")
+}
+
+// GetStats Returns the delivery stats of every hook
+func (wh *Webhooks) GetStats() []WebhookStats {
+	ret := []WebhookStats{}
+	for _, hook := range wh.hooks {
+		hook.lock.Lock()
+		stats := hook.stats
+		hook.lock.Unlock()
+		stats.Queued = len(hook.queue)
+		ret = append(ret, stats)
+	}
+
+	return ret
+}
+
+// dispatch Queues every event in the hooks interested in it, never blocks
+func (wh *Webhooks) dispatch() {
+	defer wh.wg.Done()
+
+	for e := range wh.subscription.C {
+		for _, hook := range wh.hooks {
+			if !hook.wants(e) {
+				continue
+			}
+			select {
+			case hook.queue <- e:
+			default:
+				hook.lock.Lock()
+				hook.stats.Dropped++
+				hook.lock.Unlock()
+				logWarnf("WEBHOOK %s queue full, dropped %s %s", hook.config.URL, e.Type, e.Key)
+			}
+		}
+	}
+}
+
+func (hook *webhook) wants(e ObjectEvent) bool {
+	if len(hook.events) > 0 && !hook.events[e.Type] {
+		return false
+	}
+	return matchesKey(hook.config.Match, e.Key)
+}
+
+// send Delivers the queued events of a hook, in order, with retries and backoff
+func (wh *Webhooks) send(hook *webhook) {
+	defer wh.wg.Done()
+
+	for {
+		select {
+		case e := <-hook.queue:
+			wh.deliver(hook, e)
+		case <-wh.exit:
+			return
+		}
+	}
+}
+
+func (wh *Webhooks) deliver(hook *webhook, e ObjectEvent) {
+	payload := WebhookPayload{ObjectEvent: e}
+	if e.Type != EventCreated {
+		payload.DurationMs = float64(e.Time.Sub(e.ReceivedAt)) / float64(time.Millisecond)
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		logWarnf("WEBHOOK error encoding %s %s: %v", e.Type, e.Key, err)
+		return
+	}
+
+	backoff := time.Duration(wh.config.Webhooks.BackoffMs) * time.Millisecond
+	maxBackoff := time.Duration(wh.config.Webhooks.MaxBackoffMs) * time.Millisecond
+	err = wh.post(hook, e.Type, body)
+	for retry := 1; err != nil && retry <= wh.config.Webhooks.MaxRetries; retry++ {
+		logWarnf("WEBHOOK %s %s %s failed: %v, retry %d in %v", hook.config.URL, e.Type, e.Key, err, retry, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-wh.exit:
+			return
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+
+		hook.lock.Lock()
+		hook.stats.Retries++
+		hook.lock.Unlock()
+		err = wh.post(hook, e.Type, body)
+	}
+
+	hook.lock.Lock()
+	if err != nil {
+		hook.stats.Failed++
+		logWarnf("WEBHOOK %s %s %s failed, giving up: %v", hook.config.URL, e.Type, e.Key, err)
+	} else {
+		hook.stats.Delivered++
+	}
+	hook.lock.Unlock()
+}
+
+func (wh *Webhooks) post(hook *webhook, eventType string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, hook.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, eventType)
+	if hook.config.Secret != "" {
+		req.Header.Set(WebhookSignatureHeader, "sha256="+signPayload(hook.config.Secret, body))
+	}
+
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// signPayload Returns the hex HMAC-SHA256 of body
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhooksDroppedCounted(t *testing.T) {
+	release := make(chan bool)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer receiver.Close()
+
+	config := NewConfig()
+	config.Webhooks.Hooks = []WebhookConfig{{URL: receiver.URL, Match: "/wh/"}}
+	config.Webhooks.QueueSize = 1
+	config.Webhooks.MaxRetries = 0
+	wh := NewWebhooks(config)
+	wh.Start()
+	defer wh.Stop()
+	defer close(release)
+
+	// One event is being sent, one is queued, and all the rest are dropped by the hook (none by the bus)
+	for i := 0; i < 10; i++ {
+		publishEvent(EventCreated, &File{Name: "/wh/a.ts", lock: new(sync.RWMutex)})
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		stats := wh.GetStats()[0]
+		if stats.Dropped == 8 && stats.Queued == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stats = %+v, want 8 dropped and 1 queued", stats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
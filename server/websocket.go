@@ -0,0 +1,307 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsCloseTimeout Time to send the close frame
+const wsCloseTimeout = 5 * time.Second
+
+// IsWebSocketRequest Returns true if the request asks for a WebSocket upgrade
+func IsWebSocketRequest(r *http.Request) bool {
+	return websocket.IsWebSocketUpgrade(r)
+}
+
+// newUpgrader Creates a WebSocket upgrader that accepts the origins allowed by the CORS policy
+func newUpgrader(cors *Cors) *websocket.Upgrader {
+	return &websocket.Upgrader{
+		ReadBufferSize:  32 * 1024,
+		WriteBufferSize: 32 * 1024,
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				return true
+			}
+			for _, allowed := range cors.GetAllowedOrigins() {
+				if allowed == "*" || allowed == origin {
+					return true
+				}
+			}
+			return false
+		},
+	}
+}
+
+// WebSocketGetHandler Sends every chunk of the file as a binary message, and a close frame when it is complete
+func WebSocketGetHandler(waitingRequests *WaitingRequests, upstream *Upstream, egress EgressConfig, cors *Cors, basePath string, w http.ResponseWriter, r *http.Request) {
+	// The token is not part of the object key
+	name := getKeyWithout(r.URL, accessTokenParam)
+
+	f, ok := getFileForRead(waitingRequests, upstream, name, w, r)
+	if !ok {
+		addCors(w, cors)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err := getHooks().OnRead(newHookContext(name, r, f.GetHeaders(), f.GetMetadata())); err != nil {
+		addCors(w, cors)
+		w.WriteHeader(getHookErrorStatus(err))
+		return
+	}
+
+	rc, err := f.OpenReadCloser(basePath, w)
+	if err != nil {
+		logWarnf("EGRESS %s error opening: %v", name, err)
+		addCors(w, cors)
+		if os.IsNotExist(err) {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	defer rc.Close()
+
+	ws, err := newUpgrader(cors).Upgrade(w, r, w.Header())
+	if err != nil {
+		// The upgrader already answered with the error
+		logDebugf("EGRESS %s WebSocket upgrade error: %v", name, err)
+		return
+	}
+	defer ws.Close()
+
+	// Incoming messages are discarded, the read error tells that the client went away
+	clientGone := make(chan struct{})
+	go func() {
+		defer close(clientGone)
+		for {
+			if _, _, err := ws.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	if frc, fromRAM := rc.(*FileReadCloser); !fromRAM {
+		getAccessLogEntry(r).Source = "disk"
+	} else {
+		if getAccessLogEntry(r).Source == "" {
+			getAccessLogEntry(r).Source = "ram"
+		}
+		frc.egress = &egress
+		frc.done = clientGone
+		frc.chunkAligned = true
+	}
+
+	writeTimeout := time.Duration(egress.WriteTimeoutMs) * time.Millisecond
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := rc.Read(buf)
+		if n > 0 {
+			if writeTimeout > 0 {
+				ws.SetWriteDeadline(time.Now().Add(writeTimeout))
+			}
+			werr := ws.WriteMessage(websocket.BinaryMessage, buf[:n])
+			if werr != nil {
+				if isTimeout(werr) {
+					atomic.AddInt64(&egressWriteTimeouts, 1)
+					logWarnf("EGRESS %s write timeout", name)
+				}
+				return
+			}
+			getAccessLogEntry(r).BytesOut += int64(n)
+		}
+		if err == io.EOF {
+			writeClose(ws, websocket.CloseNormalClosure, "")
+			return
+		}
+		if err == ErrUploadFailed {
+			writeClose(ws, websocket.CloseInternalServerErr, err.Error())
+			return
+		}
+		if err == ErrSlowReader {
+			writeClose(ws, websocket.ClosePolicyViolation, err.Error())
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func writeClose(ws *websocket.Conn, code int, text string) {
+	ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(wsCloseTimeout))
+}
+
+// IsWebSocketIngestRequest Returns true if the request is a WebSocket upgrade under the ingest path prefix
+func IsWebSocketIngestRequest(ingest IngestConfig, r *http.Request) bool {
+	if ingest.WebSocketPathPrefix == "" || r.Method != http.MethodGet {
+		return false
+	}
+	return strings.HasPrefix(r.URL.Path, strings.TrimSuffix(ingest.WebSocketPathPrefix, "/")+"/") && IsWebSocketRequest(r)
+}
+
+// WebSocketIngestHandler Appends every binary message to the file as a chunk, closing the socket completes it.
+// The headers to store come from the query params, and from an optional initial text message with a JSON object
+func WebSocketIngestHandler(waitingRequests *WaitingRequests, replicator *Replicator, ingest IngestConfig, onlyRAM bool, cors *Cors, basePath string, w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(ingest.WebSocketPathPrefix, "/"))
+
+	ws, err := newUpgrader(cors).Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader already answered with the error
+		logDebugf("INGEST %s WebSocket upgrade error: %v", name, err)
+		return
+	}
+	defer ws.Close()
+	// Every message is buffered, bigger ones close the socket (1009)
+	ws.SetReadLimit(ingest.WebSocketMaxMessageBytes)
+
+	// The file is created with the first message, it can carry the headers
+	idle := time.Duration(ingest.IdleTimeoutMs) * time.Millisecond
+	if idle > 0 {
+		ws.SetReadDeadline(time.Now().Add(idle))
+	}
+	reqHeaders := getWebSocketIngestHeaders(r.URL.Query())
+	msgType, msg, err := ws.ReadMessage()
+	if err != nil {
+		logWarnf("INGEST %s WebSocket closed before any data: %v", name, err)
+		return
+	}
+	ws.SetReadDeadline(time.Time{})
+	if msgType == websocket.TextMessage {
+		textHeaders := map[string]string{}
+		err := json.Unmarshal(msg, &textHeaders)
+		if err != nil {
+			writeClose(ws, websocket.CloseUnsupportedData, "invalid headers message")
+			return
+		}
+		for header, value := range textHeaders {
+			reqHeaders.Set(header, value)
+		}
+		msg = nil
+	}
+
+	hooks := getHooks()
+	hookCtx := newHookContext(name, r, getHeadersFiltered(reqHeaders), nil)
+	if err := hooks.OnUploadStart(hookCtx); err != nil {
+		logWarnf("INGEST %s rejected by hook: %v", name, err)
+		writeClose(ws, websocket.ClosePolicyViolation, err.Error())
+		return
+	}
+
+	f := NewFile(name, hookCtx.Headers, getMaxAgeOr(reqHeaders.Get("Cache-Control"), -1))
+	f.SetMetadata(hookCtx.Metadata)
+
+	FilesLock.Lock()
+	Files[name] = f
+	FilesLock.Unlock()
+
+	var replicationUpload *ReplicationUpload = nil
+	if replicator != nil {
+		replicationUpload = replicator.StartUpload(http.MethodPost, f, reqHeaders)
+	}
+	var dst io.Writer = f
+	if replicationUpload != nil {
+		dst = io.MultiWriter(f, replicationUpload)
+	}
+	dst = newChunkHookWriter(hooks, hookCtx, dst)
+
+	// Stalled uploads are aborted
+	watchdog := watchIngest(f, idle, time.Duration(ingest.MaxDurationMs)*time.Millisecond, func(err error) {
+		logWarnf("INGEST %s aborted: %v", name, err)
+		ws.UnderlyingConn().SetReadDeadline(time.Now())
+	})
+
+	// Every message is one chunk
+	var errRead error
+	for {
+		if len(msg) > 0 {
+			getAccessLogEntry(r).BytesIn += int64(len(msg))
+			_, err = dst.Write(msg)
+			if err != nil {
+				errRead = err
+				break
+			}
+		}
+		msgType, msg, err = ws.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				errRead = err
+			}
+			break
+		}
+		if msgType != websocket.BinaryMessage {
+			msg = nil
+		}
+	}
+	errTimeout := watchdog.Stop()
+	if errRead == nil {
+		errRead = checkMediaIndex(f)
+	}
+
+	hookStatus := getHookAbortStatus(errRead)
+	if errRead != nil && (ingest.OnAbort == IngestPolicyFail || hookStatus != 0 || errors.Is(errRead, errInvalidMedia) || errors.Is(errRead, ErrUploadFailed)) {
+		// Interrupted, stalled or rejected, it will never be complete
+		failUpload(f)
+		if replicationUpload != nil {
+			replicationUpload.Abort()
+		}
+		logWarnf("INGEST %s failed: %v", name, errRead)
+
+		if hookStatus != 0 {
+			writeClose(ws, websocket.ClosePolicyViolation, errRead.Error())
+		} else if errTimeout != nil {
+			writeClose(ws, websocket.ClosePolicyViolation, errTimeout.Error())
+		} else if errors.Is(errRead, errInvalidMedia) {
+			writeClose(ws, websocket.CloseInvalidFramePayloadData, errRead.Error())
+		} else if errors.Is(errRead, ErrUploadFailed) {
+			writeClose(ws, websocket.ClosePolicyViolation, errRead.Error())
+		}
+		return
+	}
+	f.Close()
+	hooks.OnUploadComplete(hookCtx)
+	f.SetMetadata(hookCtx.Metadata)
+
+	if replicationUpload != nil {
+		replicationUpload.Close()
+	}
+
+	if !onlyRAM {
+		err := f.WriteToDisk(basePath)
+		if err != nil {
+			logWarnf("Error saving %s to disk: %v", name, err)
+		}
+	}
+	scheduleExpiry(f)
+	writeClose(ws, websocket.CloseNormalClosure, "")
+
+	// Awake GET requests waiting (if there are any)
+	if waitingRequests != nil {
+		waitingRequests.ReceivedDataFor(name)
+	}
+}
+
+// getWebSocketIngestHeaders Every query param (but the token) is a header to store
+func getWebSocketIngestHeaders(query url.Values) http.Header {
+	headers := http.Header{}
+	for param, values := range query {
+		if param == accessTokenParam {
+			continue
+		}
+		for _, value := range values {
+			headers.Add(param, value)
+		}
+	}
+
+	return headers
+}